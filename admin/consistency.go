@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nmarley/dashrates"
+	"github.com/projects/sls-dash-rate-service/internal/convert"
+	"github.com/projects/sls-dash-rate-service/internal/exchanges"
+	"github.com/projects/sls-dash-rate-service/internal/outbound"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// defaultDriftPct is how far, in percent, a cached price may be from a fresh
+// one before it's reported as drifted when CONSISTENCY_DRIFT_PCT is unset
+const defaultDriftPct = 2.0
+
+// consistencyTimeout is how long the live fetches for a consistency check may
+// take, leaving time to respond within the Lambda timeout
+const consistencyTimeout = 5 * time.Second
+
+// perExchangeTimeout is how long a single live fetch may take before it's
+// abandoned, set once at startup from PER_EXCHANGE_TIMEOUT_MS as in fetch
+var perExchangeTimeout = outbound.DefaultPerExchangeTimeout
+
+// stablecoinPeg is the USD value of one unit of a USD stablecoin, set once at
+// startup from STABLECOIN_PEG as in fetch
+var stablecoinPeg = 1.0
+
+// exchangeConsistency compares an exchange's cached rate with a fresh one
+type exchangeConsistency struct {
+	Exchange string `json:"exchange"`
+
+	// CachedPrice and FreshPrice are in USD, nil if there's no cached rate or
+	// the live fetch failed
+	CachedPrice *float64   `json:"cachedPrice"`
+	FreshPrice  *float64   `json:"freshPrice"`
+	FetchedAt   *time.Time `json:"fetchedAt"`
+
+	// DriftPct is how far the cached price is from the fresh one, in percent
+	// of the fresh price, nil if either is missing
+	DriftPct *float64 `json:"driftPct"`
+
+	// Drifted is set if DriftPct is beyond the threshold, or the exchange has
+	// a fresh price but none is cached
+	Drifted bool   `json:"drifted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// consistencyReport is the body returned for a consistency check
+type consistencyReport struct {
+	ThresholdPct float64               `json:"thresholdPct"`
+	Drifted      []string              `json:"drifted"`
+	Exchanges    []exchangeConsistency `json:"exchanges"`
+}
+
+// checkConsistency fetches the rate of each enabled exchange live and
+// compares it with the one cached in Redis, to catch exchanges whose cached
+// rate has stopped being updated. Fresh prices are converted to USD as fetch
+// converts them, see convert.PriceUSD, but with the cached BTC/USD rate, so
+// that BTC moving since the last fetch isn't mistaken for drift.
+func checkConsistency(ctx context.Context, redisCli *redis.Client, thresholdPct float64) (consistencyReport, error) {
+	report := consistencyReport{ThresholdPct: thresholdPct, Drifted: []string{}}
+
+	rates, err := ratestore.GetRates(redisCli)
+	if err != nil {
+		return report, err
+	}
+	cached := make(map[string]ratestore.DashUSDRate, len(rates))
+	for _, rate := range rates {
+		cached[rate.Slug] = rate
+	}
+	btcUSD, err := redisCli.Get(ratestore.MetaKey("btcusd")).Float64()
+	if err != nil && err != redis.Nil {
+		return report, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, consistencyTimeout)
+	defer cancel()
+	fresh := fetchLive(ctx, exchanges.Enabled())
+
+	for _, res := range fresh {
+		name := exchanges.Canonical(res.name)
+		entry := exchangeConsistency{Exchange: name.DisplayName}
+		if rate, ok := cached[name.Slug]; ok {
+			price, fetchedAt := rate.RateUSD, rate.FetchedAt
+			entry.CachedPrice = &price
+			entry.FetchedAt = &fetchedAt
+		}
+
+		if res.err == nil {
+			var price float64
+			price, res.err = convert.PriceUSD(res.info, btcUSD, stablecoinPeg)
+			if res.err == nil && price <= 0 {
+				res.err = fmt.Errorf("invalid fresh price %v", price)
+			}
+			if res.err == nil {
+				entry.FreshPrice = &price
+			}
+		}
+		switch {
+		case res.err != nil:
+			entry.Error = res.err.Error()
+		case entry.CachedPrice == nil:
+			entry.Drifted = true
+		default:
+			drift := math.Abs(*entry.CachedPrice-*entry.FreshPrice) / *entry.FreshPrice * 100
+			entry.DriftPct = &drift
+			entry.Drifted = drift > thresholdPct
+		}
+		if entry.Drifted {
+			report.Drifted = append(report.Drifted, entry.Exchange)
+		}
+		report.Exchanges = append(report.Exchanges, entry)
+	}
+	sort.Slice(report.Exchanges, func(i, j int) bool {
+		return report.Exchanges[i].Exchange < report.Exchanges[j].Exchange
+	})
+	sort.Strings(report.Drifted)
+	return report, nil
+}
+
+// liveRate is a rate fetched for a consistency check, or the error fetching
+// it, along with the display name of the exchange it was fetched from
+type liveRate struct {
+	name string
+	info *dashrates.RateInfo
+	err  error
+}
+
+// fetchLive fetches the rate of each of apis concurrently with
+// outbound.FetchRate, the way fetch does, so each fetch is abandoned after
+// perExchangeTimeout or once ctx is done.
+func fetchLive(ctx context.Context, apis []dashrates.RateAPI) []liveRate {
+	results := make([]liveRate, len(apis))
+	var wg sync.WaitGroup
+	for i, api := range apis {
+		wg.Add(1)
+		go func(i int, api dashrates.RateAPI) {
+			defer wg.Done()
+			info, err := outbound.FetchRate(ctx, api, perExchangeTimeout)
+			if err == nil && info == nil {
+				err = fmt.Errorf("no rate returned")
+			}
+			results[i] = liveRate{name: api.DisplayName(), info: info, err: err}
+		}(i, api)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/convert"
+	"github.com/projects/sls-dash-rate-service/internal/exchanges"
+	"github.com/projects/sls-dash-rate-service/internal/logging"
+	"github.com/projects/sls-dash-rate-service/internal/outbound"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+// AdminHandler is our lambda handler invoked by the `lambda.Start` function
+// call. By default it reports the recent fetch success rate of each enabled
+// exchange, to help decide which exchanges to disable. On the
+// /admin/consistency path it instead compares each cached rate with a fresh
+// one, see checkConsistency.
+func AdminHandler(ctx context.Context, req events.APIGatewayProxyRequest) (Response, error) {
+	// ensure required environment variables set
+	if err := ratestore.EnvCheck([]string{"REDIS_URL"}); err != nil {
+		return serverError(err), nil
+	}
+
+	// establish redis connection
+	redisCli, err := ratestore.RedisClient(os.Getenv("REDIS_URL"))
+	if err != nil {
+		return serverError(err), nil
+	}
+
+	var report interface{}
+	if strings.HasSuffix(req.Path, "/consistency") {
+		threshold := ratestore.EnvFloat("CONSISTENCY_DRIFT_PCT", defaultDriftPct)
+		report, err = checkConsistency(ctx, redisCli, threshold)
+	} else {
+		report, err = uptimeReport(redisCli, exchanges.Names())
+	}
+	if err != nil {
+		return serverError(err), nil
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return serverError(err), nil
+	}
+	resp := Response{
+		StatusCode:      200,
+		IsBase64Encoded: false,
+		Body:            string(body),
+		Headers: map[string]string{
+			"Content-Type":           "application/json",
+			"X-MyCompany-Func-Reply": "admin-handler",
+		},
+	}
+	return resp, nil
+}
+
+func main() {
+	logging.Setup()
+	perExchangeTimeout = outbound.PerExchangeTimeout()
+	stablecoinPeg = convert.ParseStablecoinPeg()
+	outbound.Setup()
+	lambda.Start(AdminHandler)
+}
+
+// exchangeUptime summarizes the recent fetch outcomes of an exchange
+type exchangeUptime struct {
+	Exchange string `json:"exchange"`
+
+	// Attempts is the number of recent fetches recorded, at most
+	// ratestore.MaxOutcomes
+	Attempts  int `json:"attempts"`
+	Successes int `json:"successes"`
+
+	// SuccessRate is the fraction of recent fetches which succeeded, nil if
+	// none are recorded
+	SuccessRate *float64 `json:"successRate"`
+
+	// AvgFetchMs is the mean time taken by recent fetches in milliseconds,
+	// nil if none are recorded
+	AvgFetchMs *float64 `json:"avgFetchMs"`
+
+	// Last is the most recent outcome, nil if none is recorded
+	Last *ratestore.FetchOutcome `json:"last"`
+}
+
+// uptimeReport reads the recent fetch outcomes of the named exchanges in a
+// single round-trip and summarizes them.
+func uptimeReport(redisCli *redis.Client, names []string) ([]exchangeUptime, error) {
+	pipe := redisCli.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(names))
+	for i, name := range names {
+		cmds[i] = pipe.LRange(ratestore.OutcomesKey(name), 0, ratestore.MaxOutcomes-1)
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	report := make([]exchangeUptime, len(names))
+	for i, name := range names {
+		uptime := exchangeUptime{Exchange: name}
+		var totalMs int64
+		for _, val := range cmds[i].Val() {
+			var outcome ratestore.FetchOutcome
+			if err := outcome.UnmarshalBinary([]byte(val)); err != nil {
+				slog.Warn("skipping invalid fetch outcome", "key", ratestore.OutcomesKey(name), "error", err)
+				continue
+			}
+			// the list is newest first
+			if uptime.Last == nil {
+				last := outcome
+				uptime.Last = &last
+			}
+			uptime.Attempts++
+			totalMs += outcome.FetchMs
+			if outcome.OK {
+				uptime.Successes++
+			}
+		}
+		if uptime.Attempts > 0 {
+			rate := float64(uptime.Successes) / float64(uptime.Attempts)
+			uptime.SuccessRate = &rate
+			avgMs := float64(totalMs) / float64(uptime.Attempts)
+			uptime.AvgFetchMs = &avgMs
+		}
+		report[i] = uptime
+	}
+	return report, nil
+}
+
+// serverError logs err and returns a response with a generic JSON error body,
+// so internal details aren't leaked to the client. Redis connectivity failures
+// are reported as 503, anything else as 500.
+func serverError(err error) Response {
+	slog.Error("internal error", "error", err)
+	if errors.Is(err, ratestore.ErrRedisUnavailable) {
+		return errorResponse(503, "service unavailable")
+	}
+	return errorResponse(500, "internal server error")
+}
+
+// errorResponse returns a response with the given status code and a JSON body
+// describing the error.
+func errorResponse(statusCode int, message string) Response {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	return Response{
+		StatusCode: statusCode,
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
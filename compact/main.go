@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/logging"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// Response is of type APIGatewayProxyResponse, for consistency with the other
+// functions, although this one is only invoked on a schedule
+type Response events.APIGatewayProxyResponse
+
+// compactResult is the body returned by the compact handler
+type compactResult struct {
+	Keys    int   `json:"keys"`
+	Removed int64 `json:"removed"`
+}
+
+// CompactHandler is our lambda handler invoked by the `lambda.Start` function
+// call. It removes entries older than the retention window from every
+// exchange's price history. Fetch trims an exchange's history whenever it
+// stores a rate for it, so this only matters if fetches stop or an exchange
+// keeps failing, but it keeps Redis memory bounded either way.
+func CompactHandler(ctx context.Context) (Response, error) {
+	// ensure required environment variables set
+	if err := ratestore.EnvCheck([]string{"REDIS_URL"}); err != nil {
+		return Response{StatusCode: 500}, err
+	}
+
+	// establish redis connection
+	redisCli, err := ratestore.RedisClient(os.Getenv("REDIS_URL"))
+	if err != nil {
+		return Response{StatusCode: 500}, err
+	}
+
+	retention := historyRetention()
+	result, err := compactHistory(redisCli, time.Now().Add(-retention))
+	if err != nil {
+		return Response{StatusCode: 500}, err
+	}
+	slog.Info("compacted price history", "keys", result.Keys, "removed", result.Removed, "retention", retention.String())
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return Response{StatusCode: 500}, err
+	}
+	resp := Response{
+		StatusCode:      200,
+		IsBase64Encoded: false,
+		Body:            string(body),
+		Headers: map[string]string{
+			"Content-Type":           "application/json",
+			"X-MyCompany-Func-Reply": "compact-handler",
+		},
+	}
+	return resp, nil
+}
+
+func main() {
+	logging.Setup()
+	lambda.Start(CompactHandler)
+}
+
+// historyRetention returns how long price history is kept from the
+// HISTORY_RETENTION_HOURS env var, falling back to the history window if it
+// isn't a positive integer.
+func historyRetention() time.Duration {
+	defaultHours := int(ratestore.HistoryWindow / time.Hour)
+	hours := ratestore.EnvInt("HISTORY_RETENTION_HOURS", defaultHours)
+	if hours <= 0 {
+		slog.Warn("HISTORY_RETENTION_HOURS must be positive, using default", "value", hours, "default", defaultHours)
+		hours = defaultHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// compactHistory removes the entries fetched before cutoff from every price
+// history key, in a single round-trip once the keys are found, and returns
+// how many keys there were and how many entries were removed.
+func compactHistory(redisCli *redis.Client, cutoff time.Time) (compactResult, error) {
+	var result compactResult
+
+	// Collect keys via SCAN rather than KEYS, which blocks Redis
+	var keys []string
+	seen := make(map[string]bool)
+	var cursor uint64
+	for {
+		var batch []string
+		var err error
+		batch, cursor, err = redisCli.Scan(cursor, ratestore.MetaKey("history:*"), 100).Result()
+		if err != nil {
+			return result, err
+		}
+		for _, key := range batch {
+			// SCAN can return a key more than once
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	result.Keys = len(keys)
+	if len(keys) == 0 {
+		return result, nil
+	}
+
+	upper := "(" + strconv.FormatInt(cutoff.Unix(), 10)
+	pipe := redisCli.Pipeline()
+	cmds := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.ZRemRangeByScore(key, "-inf", upper)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return result, err
+	}
+	for _, cmd := range cmds {
+		result.Removed += cmd.Val()
+	}
+	return result, nil
+}
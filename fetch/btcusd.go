@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/projects/sls-dash-rate-service/internal/outbound"
+)
+
+// coinGeckoURL is the CoinGecko API endpoint for the BTC/USD price
+const coinGeckoURL = "https://api.coingecko.com/api/v3/simple/price?ids=bitcoin&vs_currencies=usd"
+
+// btcUSDSource is a named source for the BTC/USD reference rate
+type btcUSDSource struct {
+	name  string
+	fetch func(ctx context.Context) (float64, time.Time, error)
+}
+
+// btcUSDSources are the sources for the BTC/USD reference rate, in order of
+// preference
+var btcUSDSources = []btcUSDSource{
+	{name: "CoinCap", fetch: fetchBTCUSDCoinCap},
+	{name: "CoinGecko", fetch: fetchBTCUSDCoinGecko},
+}
+
+// fetchBTCUSD fetches the BTC/USD reference rate and the time it was fetched,
+// trying each of btcUSDSources in order until one returns a nonzero rate.
+func fetchBTCUSD(ctx context.Context) (float64, time.Time, error) {
+	var errs []string
+	for _, src := range btcUSDSources {
+		rate, fetchedAt, err := src.fetch(ctx)
+		if err == nil && rate == 0 {
+			err = fmt.Errorf("zero rate")
+		}
+		if err != nil {
+			slog.Warn("BTC/USD source failed", "source", src.name, "error", err)
+			errs = append(errs, fmt.Sprintf("%s: %v", src.name, err))
+			continue
+		}
+		slog.Info("fetched BTC/USD rate", "source", src.name, "price", rate)
+		return rate, fetchedAt, nil
+	}
+	return 0, time.Time{}, fmt.Errorf("no BTC/USD source available (%s)", strings.Join(errs, "; "))
+}
+
+// errNotBTCUSD is returned when a BTC/USD source reports a price for some
+// other pair, which would otherwise misprice every BTC-quoted rate
+var errNotBTCUSD = errors.New("not a BTC/USD rate")
+
+// fetchBTCUSDCoinCap fetches the BTC/USD rate from CoinCap, checking that it's
+// for the pair expected, in case dashrates changes what CoinCap is asked for.
+func fetchBTCUSDCoinCap(ctx context.Context) (float64, time.Time, error) {
+	info, err := fetchRate(ctx, outbound.CoinCapAPI())
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if info.BaseCurrency != "BTC" || info.QuoteCurrency != "USD" {
+		return 0, time.Time{}, fmt.Errorf("%w: got %s/%s", errNotBTCUSD, info.BaseCurrency, info.QuoteCurrency)
+	}
+	return info.LastPrice, info.FetchTime, nil
+}
+
+// fetchBTCUSDCoinGecko fetches the BTC/USD rate from CoinGecko
+func fetchBTCUSDCoinGecko(ctx context.Context) (float64, time.Time, error) {
+	var prices struct {
+		Bitcoin struct {
+			USD float64 `json:"usd"`
+		} `json:"bitcoin"`
+	}
+	if err := getJSON(ctx, coinGeckoURL, &prices); err != nil {
+		return 0, time.Time{}, err
+	}
+	return prices.Bitcoin.USD, time.Now(), nil
+}
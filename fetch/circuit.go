@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/exchanges"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// defaultCircuitThreshold is the number of consecutive failures after which an
+// exchange is skipped when CIRCUIT_BREAKER_THRESHOLD is unset
+const defaultCircuitThreshold = 5
+
+// defaultCircuitCooldownSec is how long an exchange is skipped once its circuit
+// opens when CIRCUIT_BREAKER_COOLDOWN_SEC is unset
+const defaultCircuitCooldownSec = 3600
+
+// circuit states reported in the fetch summary
+const (
+	circuitClosed = "closed"
+	circuitOpen   = "open"
+)
+
+// failuresKey is the Redis key counting consecutive fetch failures for an
+// exchange
+func failuresKey(exchName string) string {
+	return ratestore.MetaKey("failures:" + exchanges.Slug(exchName))
+}
+
+// circuitKey is the Redis key which exists, until the cooldown expires it,
+// while an exchange's circuit is open
+func circuitKey(exchName string) string {
+	return ratestore.MetaKey("circuit:" + exchanges.Slug(exchName))
+}
+
+// circuitThreshold returns the number of consecutive failures which open an
+// exchange's circuit, or 0 if the circuit breaker is disabled
+func circuitThreshold() int {
+	threshold := ratestore.EnvInt("CIRCUIT_BREAKER_THRESHOLD", defaultCircuitThreshold)
+	if threshold < 0 {
+		return 0
+	}
+	return threshold
+}
+
+// openCircuits returns the names of the given exchanges whose circuit is open,
+// meaning they should be skipped.
+func openCircuits(redisCli *redis.Client, names []string) (map[string]bool, error) {
+	pipe := redisCli.Pipeline()
+	cmds := make([]*redis.IntCmd, len(names))
+	for i, name := range names {
+		cmds[i] = pipe.Exists(circuitKey(name))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	open := make(map[string]bool)
+	for i, name := range names {
+		if cmds[i].Val() > 0 {
+			slog.Warn("circuit open, skipping exchange", "exchange", name)
+			open[name] = true
+		}
+	}
+	return open, nil
+}
+
+// updateCircuits updates the consecutive failure count of each exchange
+// given whether its fetch failed, opening the circuit of those which reach the
+// threshold. A success resets the count. The failure count is kept when the
+// circuit opens, so that once the cooldown expires a single further failure
+// opens it again. It returns the circuit state of each exchange.
+func updateCircuits(redisCli *redis.Client, failed map[string]bool, threshold int) map[string]string {
+	states := make(map[string]string, len(failed))
+
+	pipe := redisCli.Pipeline()
+	incrs := make(map[string]*redis.IntCmd)
+	for name, fail := range failed {
+		states[name] = circuitClosed
+		if !fail {
+			pipe.Del(failuresKey(name))
+			continue
+		}
+		incrs[name] = pipe.Incr(failuresKey(name))
+		pipe.Expire(failuresKey(name), rateTTL)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		slog.Warn("unable to record fetch outcomes", "error", err)
+		return states
+	}
+
+	cooldown := time.Duration(ratestore.EnvInt("CIRCUIT_BREAKER_COOLDOWN_SEC", defaultCircuitCooldownSec)) * time.Second
+	for name, incr := range incrs {
+		if incr.Val() < int64(threshold) {
+			continue
+		}
+		if err := redisCli.Set(circuitKey(name), incr.Val(), cooldown).Err(); err != nil {
+			slog.Warn("unable to open circuit", "exchange", name, "error", err)
+			continue
+		}
+		slog.Warn("circuit opened", "exchange", name, "failures", incr.Val(), "cooldown", cooldown)
+		states[name] = circuitOpen
+	}
+	return states
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/nmarley/dashrates"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// mockRateAPI is a dashrates.RateAPI returning a canned rate or error, so the
+// fetch, convert and store flow can be tested without the network
+type mockRateAPI struct {
+	name string
+	info *dashrates.RateInfo
+	err  error
+}
+
+// FetchRate is part of the dashrates.RateAPI interface
+func (m *mockRateAPI) FetchRate() (*dashrates.RateInfo, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	info := *m.info
+	return &info, nil
+}
+
+// DisplayName is part of the dashrates.RateAPI interface
+func (m *mockRateAPI) DisplayName() string {
+	return m.name
+}
+
+// testFX are the FX rates the tests' rate sources return
+var testFX = map[string]float64{"EUR": 0.9, "GBP": 0.8}
+
+// testSources returns rate sources fetching from apis, with a fixed BTC/USD
+// rate and FX rates
+func testSources(apis ...dashrates.RateAPI) rateSources {
+	return rateSources{
+		apis: apis,
+		btcUSD: func(context.Context) (float64, time.Time, error) {
+			return testBTCUSD, testFetchTime, nil
+		},
+		fx: func(context.Context) (map[string]float64, error) {
+			return testFX, nil
+		},
+	}
+}
+
+// testRedis starts a miniredis server, returning it and a store backed by it
+func testRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client, *ratestore.RedisStore) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	redisCli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { redisCli.Close() })
+	return mr, redisCli, &ratestore.RedisStore{Client: redisCli}
+}
+
+func TestFetchAndStoreRatesWith(t *testing.T) {
+	t.Setenv("FETCH_MAX_RETRIES", "0")
+	mr, redisCli, store := testRedis(t)
+	sources := testSources(
+		&mockRateAPI{name: "Kraken", info: rateInfo("DASH", "USD", 75, 100)},
+		&mockRateAPI{name: "Binance", info: rateInfo("DASH", "BTC", 0.0076, 0)},
+		&mockRateAPI{name: "Yobit", err: errors.New("connection refused")},
+	)
+
+	summary, _, err := fetchAndStoreRatesWith(context.Background(), redisCli, store, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Attempted != 3 || summary.Succeeded != 2 || summary.Stored != 2 {
+		t.Errorf("attempted %d, succeeded %d, stored %d, want 3, 2, 2",
+			summary.Attempted, summary.Succeeded, summary.Stored)
+	}
+	if len(summary.Errors) != 1 || summary.Errors[0].Exchange != "Yobit" || summary.Errors[0].Category != failFetch {
+		t.Errorf("errors = %+v, want Yobit fetch failure", summary.Errors)
+	}
+
+	want := map[string]float64{"kraken": 75, "binance": 76}
+	for slug, price := range want {
+		key := ratestore.KeyPrefix() + slug
+		val, err := mr.Get(key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		var rate ratestore.DashUSDRate
+		if err := json.Unmarshal([]byte(val), &rate); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if !approxEqual(rate.RateUSD, price) {
+			t.Errorf("%s price = %v, want %v", key, rate.RateUSD, price)
+		}
+		if !approxEqual(rate.Prices["EUR"], price*testFX["EUR"]) {
+			t.Errorf("%s EUR price = %v, want %v", key, rate.Prices["EUR"], price*testFX["EUR"])
+		}
+		if ttl := mr.TTL(key); ttl != rateTTL {
+			t.Errorf("%s TTL = %v, want %v", key, ttl, rateTTL)
+		}
+		if !mr.Exists(ratestore.HistoryKey(rate.Name)) {
+			t.Errorf("no history for %s", rate.Name)
+		}
+	}
+	if mr.Exists(ratestore.KeyPrefix() + "yobit") {
+		t.Error("rate stored for failed exchange")
+	}
+
+	if val, _ := mr.Get(ratestore.MetaKey("btcusd")); val != "10000" {
+		t.Errorf("btcusd = %q, want 10000", val)
+	}
+	var fx map[string]float64
+	val, _ := mr.Get(ratestore.MetaKey("fx"))
+	if err := json.Unmarshal([]byte(val), &fx); err != nil || fx["GBP"] != testFX["GBP"] {
+		t.Errorf("fx = %q, want %v", val, testFX)
+	}
+	if !mr.Exists(ratestore.MetaKey("lastFetchAt")) {
+		t.Error("lastFetchAt not recorded")
+	}
+}
+
+func TestFetchAndStoreRatesWithDryRun(t *testing.T) {
+	sources := testSources(&mockRateAPI{name: "Kraken", info: rateInfo("DASH", "USD", 75, 0)})
+
+	summary, rates, err := fetchAndStoreRatesWith(context.Background(), nil, nil, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 1 || rates[0].RateUSD != 75 {
+		t.Errorf("rates = %+v, want Kraken at 75", rates)
+	}
+	if summary.Stored != 0 {
+		t.Errorf("stored %d rates in a dry run", summary.Stored)
+	}
+}
+
+func TestStoreReadRoundTrip(t *testing.T) {
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+mr.Addr())
+	redisCli, err := ratestore.NewRedisClient(os.Getenv("REDIS_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redisCli.Close()
+	store := &ratestore.RedisStore{Client: redisCli}
+	sources := testSources(
+		&mockRateAPI{name: "Kraken", info: rateInfo("DASH", "USD", 75, 100)},
+		&mockRateAPI{name: "Binance", info: rateInfo("DASH", "BTC", 0.0076, 0)},
+	)
+
+	_, stored, err := fetchAndStoreRatesWith(context.Background(), redisCli, store, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rates, err := ratestore.GetRates(redisCli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != len(stored) {
+		t.Fatalf("read %d rates, want %d", len(rates), len(stored))
+	}
+	for i, got := range rates {
+		want := stored[i]
+		if got.Name != want.Name || got.Slug != want.Slug || got.RateUSD != want.RateUSD || got.Pair != want.Pair {
+			t.Errorf("read %+v, want %+v", got, want)
+		}
+		if !got.FetchedAt.Equal(testFetchTime) {
+			t.Errorf("%s FetchedAt = %v, want %v", got.Name, got.FetchedAt, testFetchTime)
+		}
+		switch {
+		case want.VolumeUSD == nil && got.VolumeUSD != nil:
+			t.Errorf("%s VolumeUSD = %v, want nil", got.Name, *got.VolumeUSD)
+		case want.VolumeUSD != nil && (got.VolumeUSD == nil || *got.VolumeUSD != *want.VolumeUSD):
+			t.Errorf("%s VolumeUSD = %v, want %v", got.Name, got.VolumeUSD, *want.VolumeUSD)
+		}
+	}
+	// Binance reported no volume, Kraken 100 DASH at $75
+	if rates[0].VolumeUSD != nil || rates[1].VolumeUSD == nil || *rates[1].VolumeUSD != 7500 {
+		t.Errorf("volumes = %v, %v, want nil, 7500", rates[0].VolumeUSD, rates[1].VolumeUSD)
+	}
+
+	// rates expire once their TTL has passed
+	mr.FastForward(rateTTL - time.Second)
+	if rates, _ := ratestore.GetRates(redisCli); len(rates) != 2 {
+		t.Errorf("read %d rates before the TTL passed, want 2", len(rates))
+	}
+	mr.FastForward(time.Second)
+	if rates, _ := ratestore.GetRates(redisCli); len(rates) != 0 {
+		t.Errorf("read %d rates after the TTL passed, want none", len(rates))
+	}
+}
+
+func TestFetchAndStoreRatesWithCancelled(t *testing.T) {
+	t.Setenv("FETCH_MAX_RETRIES", "0")
+	mr, redisCli, store := testRedis(t)
+	sources := testSources(&mockRateAPI{name: "Kraken", info: rateInfo("DASH", "USD", 75, 100)})
+
+	// the invocation's deadline has already passed, so nothing may be written
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := fetchAndStoreRatesWith(ctx, redisCli, store, sources)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("wrote %v after the context was cancelled", keys)
+	}
+	if mr.Exists(ratestore.MetaKey("lastFetchAt")) {
+		t.Error("lastFetchAt recorded after the context was cancelled")
+	}
+}
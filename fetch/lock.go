@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// defaultFetchLockTTL is how long the fetch lock is held for when the
+// invocation has no deadline. It's a little longer than the Lambda timeout in
+// serverless.yml.
+const defaultFetchLockTTL = 15 * time.Second
+
+// fetchLockMargin is how much longer than the invocation's remaining time the
+// fetch lock is held for, so it can't expire while the run is still writing
+const fetchLockMargin = 5 * time.Second
+
+// releaseLockScript deletes the lock key only if it still holds the given
+// token, so a run whose lock expired can't release another run's lock
+var releaseLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// fetchLockKey is the Redis key held by the fetch run in progress
+func fetchLockKey() string {
+	return ratestore.MetaKey("fetchLock")
+}
+
+// acquireFetchLock takes the fetch lock with SET NX PX, so that overlapping
+// invocations (e.g. the schedule and a manual run) don't both fetch and write
+// the same keys. It's held until the returned release func is called, or a
+// little past ctx's deadline. acquired is false if another run holds it.
+func acquireFetchLock(ctx context.Context, redisCli *redis.Client) (release func(), acquired bool, err error) {
+	ttl := defaultFetchLockTTL
+	if deadline, ok := ctx.Deadline(); ok {
+		ttl = time.Until(deadline) + fetchLockMargin
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(buf)
+
+	acquired, err = redisCli.SetNX(fetchLockKey(), token, ttl).Result()
+	if err != nil || !acquired {
+		return nil, false, err
+	}
+	release = func() {
+		if err := releaseLockScript.Run(redisCli, []string{fetchLockKey()}, token).Err(); err != nil {
+			slog.Warn("unable to release fetch lock", "error", err)
+		}
+	}
+	return release, true, nil
+}
+
+// skippedResponse is the response when another fetch run holds the lock
+func skippedResponse() Response {
+	slog.Info("another fetch is in progress, skipping")
+	body, _ := json.Marshal(map[string]bool{"skipped": true})
+	return Response{
+		StatusCode: 200,
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type":           "application/json",
+			"X-MyCompany-Func-Reply": "fetch-handler",
+		},
+	}
+}
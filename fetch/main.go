@@ -4,13 +4,25 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/nmarley/dashrates"
+	"github.com/projects/sls-dash-rate-service/internal/convert"
+	"github.com/projects/sls-dash-rate-service/internal/exchanges"
+	"github.com/projects/sls-dash-rate-service/internal/logging"
+	"github.com/projects/sls-dash-rate-service/internal/outbound"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -22,23 +34,150 @@ import (
 // https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
 type Response events.APIGatewayProxyResponse
 
+// defaultFetchMaxRetries is the number of times a failed exchange fetch is
+// retried when FETCH_MAX_RETRIES is unset
+const defaultFetchMaxRetries = 2
+
+// initialFetchBackoff is the wait before the first retry of a failed exchange
+// fetch, doubling for each subsequent retry
+const initialFetchBackoff = 250 * time.Millisecond
+
+// defaultRateTTLSec is the expiration for rates stored in Redis when
+// RATE_TTL_SEC is unset
+const defaultRateTTLSec = 86400
+
+// rateTTL is the expiration for rates stored in Redis, set once at startup
+var rateTTL = defaultRateTTLSec * time.Second
+
+// fxURL is the API used to fetch USD exchange rates for other fiat currencies
+const fxURL = "https://api.frankfurter.app/latest"
+
+// fxCurrencies are the fiat currencies, besides USD, that serve can express
+// rates in
+var fxCurrencies = []string{"EUR", "GBP"}
+
+// perExchangeTimeout is how long a single exchange fetch may take before it's
+// abandoned, set once at startup from PER_EXCHANGE_TIMEOUT_MS
+var perExchangeTimeout = outbound.DefaultPerExchangeTimeout
+
+// maxClockSkew is how far in the future an exchange's fetch time may be
+// before it's replaced with the current time
+const maxClockSkew = 30 * time.Second
+
+// defaultFetchTimeoutMS is the overall deadline for fetching rates from all
+// exchanges when FETCH_TIMEOUT_MS is unset
+const defaultFetchTimeoutMS = 5000
+
+// volumeInQuote are the exchanges whose dashrates.RateInfo BaseAssetVolume is
+// actually denominated in the quote currency rather than in DASH. Exchanges not
+// listed are assumed to report DASH volume. As of the vendored dashrates:
+//
+//   - Binance, Coinbase, CoinCap and Huobi report no volume.
+//   - Bittrex and Poloniex report DASH volume; their APIs name base and quote
+//     volume the other way around, which dashrates already swaps back.
+//   - BigONE, Bitfinex, CEX.IO, Coinbase Pro, Exmo, HitBTC, Kraken, Livecoin
+//     and Yobit report DASH volume.
+//   - Digifinex reports its base_vol field, which is USDT volume.
+var volumeInQuote = map[string]bool{
+	"Digifinex": true,
+}
+
+// priceDecimals is the number of decimal places USD prices are rounded to, or
+// -1 to leave them unrounded, set once at startup from PRICE_DECIMALS
+var priceDecimals = -1
+
+// volumeDecimals is the number of decimal places USD volumes are rounded to,
+// or -1 to leave them unrounded, set once at startup from VOLUME_DECIMALS
+var volumeDecimals = -1
+
+// stablecoinPeg is the USD value of one unit of a USD stablecoin, set once at
+// startup from STABLECOIN_PEG
+var stablecoinPeg = 1.0
+
+// includeRaw is whether rates keep the exchange's own price and quote
+// currency alongside the USD price, set once at startup from INCLUDE_RAW
+var includeRaw bool
+
 // Handler is our lambda handler invoked by the `lambda.Start` function call
 func Handler(ctx context.Context) (Response, error) {
-	// fetch and store rates in Redis
-	err := fetchAndStoreRates()
+	start := time.Now()
+
+	// in a dry run, rates are fetched and converted but Redis isn't touched
+	dryRun := ratestore.EnvBool("DRY_RUN")
+
+	// rates are stored in the store selected with RATE_STORE. Anything other
+	// than Redis only keeps the rates, so none of the Redis bookkeeping
+	// (history, circuits, the fetch lock, ...) is done.
+	kind, err := ratestore.StoreKind()
 	if err != nil {
-		return Response{StatusCode: 404}, err
+		return serverError(err), nil
 	}
+	var store ratestore.RateStore
+	var redisCli *redis.Client
+	switch {
+	case dryRun:
+	case kind == ratestore.StoreDynamoDB:
+		if store, err = ratestore.NewDynamoStore(); err != nil {
+			return serverError(err), nil
+		}
+	default:
+		// ensure required environment variables set
+		if err := ratestore.EnvCheck([]string{"REDIS_URL"}); err != nil {
+			return serverError(err), nil
+		}
 
-	var buf bytes.Buffer
+		// establish redis connection
+		redisCli, err = ratestore.RedisClient(os.Getenv("REDIS_URL"))
+		if err != nil {
+			return serverError(err), nil
+		}
+		store = &ratestore.RedisStore{Client: redisCli}
+
+		// only one run at a time fetches and writes rates
+		release, acquired, err := acquireFetchLock(ctx, redisCli)
+		if err != nil {
+			return serverError(err), nil
+		}
+		if !acquired {
+			return skippedResponse(), nil
+		}
+		defer release()
+	}
+
+	// fetch rates and put them in the store
+	summary, rates, err := fetchAndStoreRates(ctx, redisCli, store)
+	emitMetrics(time.Since(start), summary)
+	if err != nil {
+		return serverError(err), nil
+	}
+
+	// fetch rates back from the store and return them all here
+	if store != nil {
+		rates, err = store.GetAll(ctx)
+		if err != nil {
+			return serverError(err), nil
+		}
+	}
+	if redisCli != nil {
+		// let live clients know the rates have changed
+		pushRates(ctx, redisCli, rates)
+	}
 
-	// TODO: Fetch rates from cache and return them all here...
+	var warning string
+	if summary.RedisWriteFailures > 0 {
+		warning = fmt.Sprintf("%d of %d redis writes failed", summary.RedisWriteFailures,
+			summary.RedisWrites+summary.RedisWriteFailures)
+	}
 
-	body, err := json.Marshal(map[string]interface{}{
-		"message": "Go Serverless v1.0! Your function executed successfully!",
+	var buf bytes.Buffer
+	body, err := json.Marshal(fetchResponse{
+		Rates:        rates,
+		DryRun:       dryRun,
+		Warning:      warning,
+		fetchSummary: summary,
 	})
 	if err != nil {
-		return Response{StatusCode: 404}, err
+		return serverError(err), nil
 	}
 	json.HTMLEscape(&buf, body)
 
@@ -51,177 +190,689 @@ func Handler(ctx context.Context) (Response, error) {
 			"X-MyCompany-Func-Reply": "fetch-handler",
 		},
 	}
+	if warning != "" {
+		resp.Headers["Warning"] = fmt.Sprintf("199 - %q", warning)
+	}
 
 	return resp, nil
 }
 
 func main() {
+	logging.Setup()
+	rateTTL = parseRateTTL()
+	perExchangeTimeout = outbound.PerExchangeTimeout()
+	stablecoinPeg = convert.ParseStablecoinPeg()
+	priceDecimals = parseDecimals("PRICE_DECIMALS")
+	volumeDecimals = parseDecimals("VOLUME_DECIMALS")
+	priceSanityPct = parsePriceSanityPct()
+	includeRaw = ratestore.EnvBool("INCLUDE_RAW")
+	rateLimitBackoff = ratestore.EnvBool("RATE_LIMIT_BACKOFF")
+	outbound.Setup()
 	lambda.Start(Handler)
 }
 
-// fetchAndStoreRates fetches exchange rates and stores them in Redis
+// parseRateTTL returns the expiration for rates stored in Redis from the
+// RATE_TTL_SEC env var, falling back to the default if it isn't a positive
+// integer.
+func parseRateTTL() time.Duration {
+	ttl := ratestore.EnvInt("RATE_TTL_SEC", defaultRateTTLSec)
+	if ttl <= 0 {
+		slog.Warn("RATE_TTL_SEC must be positive, using default", "value", ttl, "default", defaultRateTTLSec)
+		ttl = defaultRateTTLSec
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// parseDecimals returns the number of decimal places to round to from the
+// named env var, or -1 if it's unset or negative.
+func parseDecimals(name string) int {
+	decimals := ratestore.EnvInt(name, -1)
+	if decimals < 0 {
+		return -1
+	}
+	return decimals
+}
+
+// roundPrice rounds price to priceDecimals decimal places, if set.
+func roundPrice(price float64) float64 {
+	return roundTo(price, priceDecimals)
+}
+
+// roundVolume rounds volume to volumeDecimals decimal places, if set.
+func roundVolume(volume float64) float64 {
+	return roundTo(volume, volumeDecimals)
+}
+
+// roundTo rounds val to the given number of decimal places, or returns it as
+// is if decimals is negative.
+func roundTo(val float64, decimals int) float64 {
+	if decimals < 0 {
+		return val
+	}
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(val*scale) / scale
+}
+
+// fetchAndStoreRates fetches exchange rates and stores them
 //
-// TODO: Add a channel for passing dashrates.RateInfo back to the main and
-// concurrently fetch ALL rates, including the coincap one. The single wait for
-// this one fetch is slowing down the entire process.
+// main logic of this util:
 //
-// Then AFTER wg.Wait() (all fetch goroutines are done executing), process the
-// Dash/USD conversions and store in Redis (this takes < 30 milliseconds).
+//  1. Concurrently fetch the BTC/USD rate and the rate for each exchange,
+//     passing each dashrates.RateInfo back over a channel. The BTC/USD rate
+//     falls back to other sources if CoinCap is unavailable.
+//  2. After all fetches are done, convert each exchange rate to USD amounts if
+//     needed (using BTC/USD rate), and from USD to the other supported fiat
+//     currencies. This takes < 30 milliseconds.
+//  3. Put the rates in store w/an expiration, all in one batch. With Redis,
+//     the BTC/USD and FX rates and each exchange's price history are then
+//     written in a single round-trip, and the time of the fetch is recorded
+//     if any rates were stored.
 //
-// main logic of this util:
+// Exchanges which haven't responded within FETCH_TIMEOUT_MS are skipped, and
+// the rates which were fetched in time are still stored. Nothing is stored
+// once ctx itself is done, so no writes happen after the invocation ends.
+// Per-exchange failures are collected in the returned summary, and an error is
+// only returned if no rates could be stored at all. The converted rates are
+// also returned.
 //
-// 1. Get BTC/USD rate first
-// 2. For each exchange, pull the rate and convert to USD amounts if needed
-//    (using BTC/USD rate).
-// 3. Put into Redis w/an expiration
-func fetchAndStoreRates() error {
-	// ensure required environment variables set
-	if err := envCheck([]string{"REDIS_URL"}); err != nil {
-		return err
-	}
+// redisCli is the Redis client when store is a RedisStore, and nil otherwise,
+// in which case none of the Redis bookkeeping is done. If store is nil (a dry
+// run), nothing is stored.
+func fetchAndStoreRates(ctx context.Context, redisCli *redis.Client, store ratestore.RateStore) (fetchSummary, []ratestore.DashUSDRate, error) {
+	return fetchAndStoreRatesWith(ctx, redisCli, store, rateSources{
+		apis:   exchanges.Enabled(),
+		btcUSD: fetchBTCUSD,
+		fx:     fetchFXRates,
+	})
+}
 
-	// establish redis connection
-	redisCli, err := redisCliCheck(os.Getenv("REDIS_URL"))
-	if err != nil {
-		return err
+// rateSources are where fetchAndStoreRatesWith gets rates from, so they can be
+// swapped out for canned ones without making network calls.
+type rateSources struct {
+	// apis are the exchanges to fetch Dash rates from
+	apis []dashrates.RateAPI
+	// btcUSD fetches the BTC/USD rate used to convert BTC-quoted rates, and
+	// the time it was fetched
+	btcUSD func(context.Context) (float64, time.Time, error)
+	// fx fetches USD exchange rates for other fiat currencies
+	fx func(context.Context) (map[string]float64, error)
+}
+
+// fetchAndStoreRatesWith is fetchAndStoreRates, fetching rates from the given
+// sources.
+func fetchAndStoreRatesWith(ctx context.Context, redisCli *redis.Client, store ratestore.RateStore, sources rateSources) (fetchSummary, []ratestore.DashUSDRate, error) {
+	summary := fetchSummary{Errors: []fetchError{}}
+
+	apis := sources.apis
+
+	// skip exchanges which have been failing repeatedly
+	threshold := circuitThreshold()
+	useCircuits := redisCli != nil && threshold > 0
+	if useCircuits {
+		names := make([]string, len(apis))
+		for i, api := range apis {
+			names[i] = api.DisplayName()
+		}
+		open, err := openCircuits(redisCli, names)
+		if err != nil {
+			slog.Warn("unable to check circuits, fetching all exchanges", "error", err)
+		}
+		summary.Circuits = make(map[string]string)
+		var closed []dashrates.RateAPI
+		for _, api := range apis {
+			if open[api.DisplayName()] {
+				summary.Circuits[api.DisplayName()] = circuitOpen
+				continue
+			}
+			closed = append(closed, api)
+		}
+		apis = closed
 	}
 
-	// 1. Fetch BTC/USD rate
-	coinCapAPI := dashrates.NewCoinCapAPI()
-	coinCapRI, err := coinCapAPI.FetchRate()
-	if err != nil {
-		return err
+	// skip exchanges whose provider has recently rate limited us
+	useRateLimits := redisCli != nil && rateLimitBackoff
+	hosts := make(map[string]string)
+	if useRateLimits {
+		var hostList []string
+		for _, api := range apis {
+			if host := exchanges.Provider(api.DisplayName()); host != "" {
+				hosts[api.DisplayName()] = host
+				hostList = append(hostList, host)
+			}
+		}
+		limited, err := rateLimitedHosts(redisCli, hostList)
+		if err != nil {
+			slog.Warn("unable to check rate limits, fetching all exchanges", "error", err)
+		}
+		var allowed []dashrates.RateAPI
+		for _, api := range apis {
+			if limited[hosts[api.DisplayName()]] {
+				slog.Warn("provider rate limited, skipping exchange", "exchange", api.DisplayName(), "host", hosts[api.DisplayName()])
+				summary.RateLimited = append(summary.RateLimited, api.DisplayName())
+				continue
+			}
+			allowed = append(allowed, api)
+		}
+		apis = allowed
 	}
+	summary.Attempted = len(apis)
 
-	// now we have BTC/USD rate
-	rateBitcoinUSD := coinCapRI.LastPrice
-
-	// 2. For each exchange, pull the rate and convert to USD amounts if needed
-	//    (using BTC/USD rate).
-	apis := []dashrates.RateAPI{
-		dashrates.NewBinanceAPI(),
-		dashrates.NewKrakenAPI(),
-		dashrates.NewBitfinexAPI(),
-		dashrates.NewPoloniexAPI(),
-		dashrates.NewHuobiAPI(),
-		dashrates.NewBittrexAPI(),
-		dashrates.NewLivecoinAPI(),
-		dashrates.NewExmoAPI(),
-		dashrates.NewHitBTCAPI(),
-		dashrates.NewYobitAPI(),
-		dashrates.NewCexAPI(),
-		dashrates.NewBigONEAPI(),
-		dashrates.NewCoinbaseProAPI(),
-		dashrates.NewCoinbaseAPI(),
-		dashrates.NewDigifinexAPI(),
+	maxRetries := ratestore.EnvInt("FETCH_MAX_RETRIES", defaultFetchMaxRetries)
+	if maxRetries < 0 {
+		maxRetries = 0
 	}
 
+	// 1. Concurrently fetch all rates, including the BTC/USD one, bounding
+	//    the time spent waiting on exchanges.
+	timeout := time.Duration(ratestore.EnvInt("FETCH_TIMEOUT_MS", defaultFetchTimeoutMS)) * time.Millisecond
+	fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := make(chan rateResult, len(apis))
 	var wg sync.WaitGroup
+
+	// BTC/USD reference rate, used to convert BTC-quoted exchange rates
+	var rateBitcoinUSD float64
+	var btcFetchedAt time.Time
+	var btcErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rateBitcoinUSD, btcFetchedAt, btcErr = sources.btcUSD(fetchCtx)
+	}()
+
+	// USD exchange rates for other fiat currencies, which serve converts to
+	var fxRates map[string]float64
+	var fxErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fxRates, fxErr = sources.fx(fetchCtx)
+	}()
+
+	// optionally bound how many exchanges are fetched from at once, so they
+	// aren't all hit from the same IP simultaneously
+	var sem chan struct{}
+	if concurrency := ratestore.EnvInt("FETCH_CONCURRENCY", 0); concurrency > 0 {
+		sem = make(chan struct{}, concurrency)
+	}
+
 	for _, rateAPI := range apis {
 		wg.Add(1)
 		go func(api dashrates.RateAPI) {
 			defer wg.Done()
-			rate, err := api.FetchRate()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error: %v", err.Error())
-				return
-			}
-
-			usdRate, err := getDashRateInUSD(rateBitcoinUSD, api.DisplayName(), rate)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error: %v", err.Error())
-				return
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-fetchCtx.Done():
+					results <- rateResult{name: api.DisplayName(), err: fmt.Errorf("fetch abandoned: %v", fetchCtx.Err())}
+					return
+				}
 			}
-			fmt.Printf("rate for %s: %+v\n", api.DisplayName(), usdRate)
-
-			// set the value w/a expiration (future calls to set will reset the
-			// ttl)
-			_, err = redisCli.Set(api.DisplayName(), usdRate, 24*time.Hour).Result()
+			// time only the fetch, including any retries
+			start := time.Now()
+			rate, err := fetchRateWithRetry(fetchCtx, api, maxRetries)
+			elapsed := time.Since(start)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "redis set err: %v", err.Error())
+				results <- rateResult{name: api.DisplayName(), err: err, elapsed: elapsed}
 				return
 			}
+			results <- rateResult{name: api.DisplayName(), info: *rate, elapsed: elapsed}
 		}(rateAPI)
 	}
 	wg.Wait()
-	fmt.Println("...done!")
+	close(results)
 
-	return nil
+	if btcErr != nil {
+		summary.addError("BTC/USD", failFetch, btcErr)
+	}
+	if fxErr != nil {
+		summary.addError("FX", failFetch, fxErr)
+	}
+
+	var exchRates []rateResult
+	failed := make(map[string]bool)
+	fetchErrs := make(map[string]error)
+	summary.FetchMs = make(map[string]int64)
+	for res := range results {
+		failed[res.name] = res.err != nil
+		fetchErrs[res.name] = res.err
+		summary.FetchMs[res.name] = res.elapsed.Milliseconds()
+		if res.err != nil {
+			summary.addError(res.name, failFetch, res.err)
+			continue
+		}
+		exchRates = append(exchRates, res)
+	}
+	// fetches which failed because the invocation ended aren't the exchanges'
+	// fault, so they're kept out of the circuits, outcomes and rate limits
+	if ctx.Err() == nil {
+		if useCircuits {
+			for name, state := range updateCircuits(redisCli, failed, threshold) {
+				summary.Circuits[name] = state
+			}
+		}
+		if redisCli != nil {
+			recordOutcomes(redisCli, fetchErrs, summary.FetchMs)
+		}
+		if useRateLimits {
+			recordRateLimits(redisCli, fetchErrs, hosts)
+		}
+	}
+
+	// 2. For each exchange, convert to USD amounts if needed (using BTC/USD
+	//    rate).
+	infos := make(map[string]*dashrates.RateInfo, len(exchRates))
+	for i := range exchRates {
+		infos[exchRates[i].name] = &exchRates[i].info
+	}
+	converted, convErrs := convertAll(rateBitcoinUSD, infos)
+	for name, err := range convErrs {
+		summary.addError(name, conversionCategory(err), err)
+	}
+	for i := range converted {
+		usdRate := &converted[i]
+		clampFetchedAt(usdRate, time.Now())
+		if fxErr == nil {
+			usdRate.Prices = fiatPrices(usdRate.RateUSD, fxRates)
+		}
+		slog.Info("fetched rate", "exchange", usdRate.Name, "price", usdRate.RateUSD, "volume", usdRate.VolumeUSD)
+	}
+
+	// 2b. Once every rate is converted, reject any too far from the consensus
+	//     price, which is most likely a broken feed.
+	converted, rejected := applySanityBand(converted, priceSanityPct)
+	for name, err := range rejected {
+		slog.Warn("rate outside sanity band, skipping", "exchange", name, "error", err)
+		summary.addError(name, failOutOfBand, err)
+	}
+	summary.Succeeded = len(converted)
+
+	if store == nil {
+		slog.Info("rates converted, not stored", "fetched", len(converted), "failed", len(summary.Errors))
+		if len(converted) == 0 {
+			return summary, converted, fmt.Errorf("no rates fetched")
+		}
+		return summary, converted, nil
+	}
+
+	// the invocation may have ended while waiting on exchanges, e.g. its
+	// deadline passed, in which case nothing should be written after the
+	// handler has given up
+	if err := ctx.Err(); err != nil {
+		return summary, converted, fmt.Errorf("not storing rates: %w", err)
+	}
+
+	// 3. Put the rates in the store in one batch, then with Redis write
+	//    everything kept alongside them.
+	writeStart := time.Now()
+	stored := putRates(ctx, store, converted, redisCli != nil, &summary)
+	if redisCli != nil {
+		storeExtras(ctx, redisCli, stored, rateBitcoinUSD, btcFetchedAt, btcErr, fxRates, fxErr, &summary)
+	}
+	slog.Debug("store write complete", "durationMs", time.Since(writeStart).Milliseconds(),
+		"writes", summary.RedisWrites, "writeFailures", summary.RedisWriteFailures)
+	slog.Info("fetch complete", "stored", summary.Stored, "failed", len(summary.Errors))
+
+	// if every write failed, Redis is most likely down rather than any one
+	// exchange's rate being at fault
+	if summary.RedisWrites == 0 && summary.RedisWriteFailures > 0 {
+		return summary, converted, fmt.Errorf("%w: %d writes failed", errRedisWritesFailed, summary.RedisWriteFailures)
+	}
+	if summary.Stored == 0 {
+		return summary, converted, fmt.Errorf("no rates stored")
+	}
+	if redisCli == nil {
+		return summary, converted, nil
+	}
+
+	// record when the dataset as a whole was last refreshed
+	lastFetchAt := time.Now().UTC().Format(time.RFC3339Nano)
+	summary.recordWrite("lastFetchAt", "set", redisCli.Set(ratestore.MetaKey("lastFetchAt"), lastFetchAt, 0).Err())
+	return summary, converted, nil
+}
+
+// serverError logs err and returns a response with a generic JSON error body,
+// so internal details aren't leaked to the client. Redis connectivity failures
+// are reported as 503, anything else as 500.
+func serverError(err error) Response {
+	slog.Error("internal error", "error", err)
+	if errors.Is(err, ratestore.ErrRedisUnavailable) || errors.Is(err, errRedisWritesFailed) {
+		return errorResponse(503, "service unavailable")
+	}
+	return errorResponse(500, "internal server error")
 }
 
-// DashUSDRate is an entry for output to the exchange rate API
-type DashUSDRate struct {
-	Name      string    `json:"exchange"`
-	RateUSD   float64   `json:"price"`
-	VolumeUSD *float64  `json:"volume,omitempty"`
-	FetchedAt time.Time `json:"fetchedAt"`
+// errorResponse returns a response with the given status code and a JSON body
+// describing the error.
+func errorResponse(statusCode int, message string) Response {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	return Response{
+		StatusCode: statusCode,
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
 }
 
-// MarshalBinary is part of the encoding.BinaryMarshaler interface
-func (rate *DashUSDRate) MarshalBinary() ([]byte, error) {
-	return json.Marshal(rate)
+// errRedisWritesFailed is returned by fetchAndStoreRates when none of its Redis
+// writes succeeded
+var errRedisWritesFailed = errors.New("error: all redis writes failed")
+
+// fetchSummary is the outcome of a single fetchAndStoreRates run
+type fetchSummary struct {
+	// Attempted and Succeeded count the exchanges fetched from, and those
+	// whose rate was fetched and converted
+	Attempted int `json:"attempted"`
+	Succeeded int `json:"succeeded"`
+
+	Stored int          `json:"stored"`
+	Errors []fetchError `json:"errors"`
+
+	// FetchMs is how long fetching from each exchange took in milliseconds,
+	// including retries but not storing the rate
+	FetchMs map[string]int64 `json:"fetchMs"`
+
+	// FailureCounts is the number of Errors in each category
+	FailureCounts map[string]int `json:"failureCounts,omitempty"`
+
+	// RedisWrites and RedisWriteFailures count the Redis writes which
+	// succeeded and failed
+	RedisWrites        int `json:"redisWrites"`
+	RedisWriteFailures int `json:"redisWriteFailures"`
+
+	// Circuits is the circuit breaker state, "open" or "closed", of each
+	// exchange. Exchanges whose circuit was already open weren't fetched.
+	Circuits map[string]string `json:"circuits,omitempty"`
+
+	// RateLimited are the exchanges which weren't fetched because their
+	// provider rate limited an earlier fetch
+	RateLimited []string `json:"rateLimited,omitempty"`
 }
 
-// UnmarshalBinary is part of the encoding.BinaryUnmarshaler interface
-func (rate *DashUSDRate) UnmarshalBinary(data []byte) error {
-	return json.Unmarshal(data, rate)
+// fetchError is a failure to fetch, convert or store the rate for an exchange
+type fetchError struct {
+	Exchange string `json:"exchange"`
+	Category string `json:"category"`
+	Error    string `json:"error"`
 }
 
-// redisCliCheck creates a Redis client and checks the connection via PING.
-func redisCliCheck(redisURL string) (*redis.Client, error) {
-	// establish redis connection
-	redisCli := redis.NewClient(&redis.Options{
-		Addr:     redisURL,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-	// ensure connected to redis
-	_, err := redisCli.Ping().Result()
+// failure categories of a fetchError
+const (
+	// failFetch is a failure to fetch a rate, e.g. a network error
+	failFetch = "fetch"
+	// failUnsupportedPair is a rate in a currency pair which can't be
+	// converted to DASH/USD
+	failUnsupportedPair = "unsupportedPair"
+	// failConversion is any other failure to convert a rate to USD
+	failConversion = "conversion"
+	// failInvalidRate is a converted rate which is nonsense to store
+	failInvalidRate = "invalidRate"
+	// failOutOfBand is a converted rate too far from the median of the batch,
+	// see PRICE_SANITY_PCT
+	failOutOfBand = "outOfBand"
+	// failRedis is a failure to store a rate
+	failRedis = "redis"
+	// failStore is a failure to put a rate in a store other than Redis
+	failStore = "store"
+)
+
+// recordWrite counts the outcome of a Redis write for the named exchange (or
+// other key), recording err as a failure of the given kind of write. It reports
+// whether the write succeeded.
+func (s *fetchSummary) recordWrite(exchName string, kind string, err error) bool {
+	if err != nil {
+		s.RedisWriteFailures++
+		s.addError(exchName, failRedis, fmt.Errorf("redis %s err: %v", kind, err))
+		return false
+	}
+	s.RedisWrites++
+	return true
+}
+
+// addError logs the failure for the given exchange and records it in the
+// summary, counting it under the given category.
+func (s *fetchSummary) addError(exchName string, category string, err error) {
+	slog.Error("exchange failed", "exchange", exchName, "category", category, "error", err)
+	s.Errors = append(s.Errors, fetchError{Exchange: exchName, Category: category, Error: err.Error()})
+	if s.FailureCounts == nil {
+		s.FailureCounts = make(map[string]int)
+	}
+	s.FailureCounts[category]++
+}
+
+// fetchResponse is the body returned by the fetch handler
+type fetchResponse struct {
+	Rates  []ratestore.DashUSDRate `json:"rates"`
+	DryRun bool                    `json:"dryRun,omitempty"`
+
+	// Warning is set when the fetch succeeded but some Redis writes failed
+	Warning string `json:"warning,omitempty"`
+	fetchSummary
+}
+
+// fetchRateWithRetry calls fetchRate, retrying up to maxRetries times with
+// exponential backoff between attempts. Retries stop once ctx is done, or
+// the provider rate limits the fetch.
+func fetchRateWithRetry(ctx context.Context, api dashrates.RateAPI, maxRetries int) (*dashrates.RateInfo, error) {
+	backoff := initialFetchBackoff
+	for attempt := 0; ; attempt++ {
+		rate, err := fetchRate(ctx, api)
+		// retrying a rate limited fetch would only make things worse
+		if err == nil || attempt >= maxRetries || ctx.Err() != nil || errors.Is(err, outbound.ErrRateLimited) {
+			return rate, err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// fetchRate fetches the rate from the given API with outbound.FetchRate,
+// giving up once ctx is done or perExchangeTimeout has passed.
+func fetchRate(ctx context.Context, api dashrates.RateAPI) (*dashrates.RateInfo, error) {
+	return outbound.FetchRate(ctx, api, perExchangeTimeout)
+}
+
+// fetchFXRates fetches the USD exchange rate (units per USD) for each of
+// fxCurrencies.
+func fetchFXRates(ctx context.Context) (map[string]float64, error) {
+	url := fxURL + "?from=USD&to=" + strings.Join(fxCurrencies, ",")
+	var fx struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := getJSON(ctx, url, &fx); err != nil {
+		return nil, fmt.Errorf("FX rates: %v", err)
+	}
+	return fx.Rates, nil
+}
+
+// getJSON makes a GET request to the given URL and decodes the JSON response
+// body into v.
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// storeFXRates queues caching the given FX rates in Redis under a reserved
+// key on pipe, returning the queued command.
+func storeFXRates(pipe redis.Pipeliner, fxRates map[string]float64) (*redis.StatusCmd, error) {
+	data, err := json.Marshal(fxRates)
 	if err != nil {
-		err := fmt.Errorf("error: unable to ping redis at '%s'", redisURL)
 		return nil, err
 	}
-	return redisCli, nil
+	return pipe.Set(ratestore.MetaKey("fx"), data, rateTTL), nil
+}
+
+// storeHistory queues adding the given rate to the price history for its
+// exchange on pipe, scored by fetch time, and trimming entries older than the
+// history window. The queued commands are returned so their results can be
+// checked once the pipeline has been executed.
+func storeHistory(pipe redis.Pipeliner, rate *ratestore.DashUSDRate) ([]redis.Cmder, error) {
+	data, err := rate.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	key := ratestore.HistoryKey(rate.Name)
+	cutoff := time.Now().Add(-ratestore.HistoryWindow).Unix()
+
+	return []redis.Cmder{
+		pipe.ZAdd(key, redis.Z{Score: float64(rate.FetchedAt.Unix()), Member: data}),
+		pipe.ZRemRangeByScore(key, "-inf", "("+strconv.FormatInt(cutoff, 10)),
+		// expire the whole history if the exchange stops being fetched
+		pipe.Expire(key, ratestore.HistoryWindow),
+	}, nil
 }
 
-// envCheck is called upon startup to ensure the required environment variables
-// are set
-func envCheck(reqd []string) error {
-	// ensure config vars set
-	missing := false
-	for _, env := range reqd {
-		val, ok := os.LookupEnv(env)
-		if !ok || (len(val) == 0) {
-			missing = true
+// rateResult is a fetched rate (or the error fetching it) along with the
+// display name of the exchange it was fetched from.
+type rateResult struct {
+	name string
+	info dashrates.RateInfo
+	err  error
+
+	// elapsed is how long fetching took, including retries
+	elapsed time.Duration
+}
+
+// convertAll converts a batch of fetched rates, keyed by exchange name, to
+// validated Dash/USD rates with getDashRateInUSD and validateRate. It returns
+// the successful conversions sorted by exchange name, and the error for each
+// exchange whose rate couldn't be converted or was invalid. It has no side
+// effects.
+func convertAll(btcUSD float64, results map[string]*dashrates.RateInfo) ([]ratestore.DashUSDRate, map[string]error) {
+	var converted []ratestore.DashUSDRate
+	errs := make(map[string]error)
+	for name, info := range results {
+		usdRate, err := getDashRateInUSD(btcUSD, name, info)
+		if err != nil {
+			errs[name] = err
+			continue
 		}
+		if err := validateRate(usdRate); err != nil {
+			errs[name] = err
+			continue
+		}
+		converted = append(converted, *usdRate)
+	}
+	sort.Slice(converted, func(i, j int) bool {
+		return converted[i].Name < converted[j].Name
+	})
+	return converted, errs
+}
+
+// conversionCategory returns the failure category of an error from
+// convertAll.
+func conversionCategory(err error) string {
+	switch {
+	case errors.Is(err, convert.ErrBaseNotDash) || errors.Is(err, convert.ErrUnknownQuote):
+		return failUnsupportedPair
+	case errors.Is(err, errInvalidRate):
+		return failInvalidRate
+	}
+	return failConversion
+}
+
+// errInvalidRate is returned by validateRate
+var errInvalidRate = errors.New("invalid rate")
+
+// validateRate rejects rates which would be nonsense to store, such as those
+// from a malformed exchange response: a price which isn't a positive finite
+// number, or a volume which isn't finite.
+func validateRate(rate *ratestore.DashUSDRate) error {
+	if math.IsNaN(rate.RateUSD) || math.IsInf(rate.RateUSD, 0) || rate.RateUSD <= 0 {
+		return fmt.Errorf("%w: price %v", errInvalidRate, rate.RateUSD)
 	}
-	if missing {
-		return fmt.Errorf("at least some required env var not set")
+	if rate.VolumeUSD != nil && (math.IsNaN(*rate.VolumeUSD) || math.IsInf(*rate.VolumeUSD, 0)) {
+		return fmt.Errorf("%w: volume %v", errInvalidRate, *rate.VolumeUSD)
 	}
 	return nil
 }
 
+// clampFetchedAt replaces a FetchedAt more than maxClockSkew after now with
+// now, flagging the rate, so that an exchange's clock skew or a bad timestamp
+// can't make a rate look fresh for longer than it is.
+func clampFetchedAt(rate *ratestore.DashUSDRate, now time.Time) {
+	if !rate.FetchedAt.After(now.Add(maxClockSkew)) {
+		return
+	}
+	slog.Warn("fetch time in the future, using current time",
+		"exchange", rate.Name, "fetchedAt", rate.FetchedAt, "now", now)
+	rate.FetchedAt = now
+	rate.FetchedAtAdjusted = true
+}
+
+// fiatPrices returns the given USD price in USD and each of the fiat currencies
+// in fxRates, which are given in units per USD.
+func fiatPrices(priceUSD float64, fxRates map[string]float64) map[string]float64 {
+	prices := map[string]float64{"USD": priceUSD}
+	for cur, rate := range fxRates {
+		prices[cur] = roundPrice(priceUSD * rate)
+	}
+	return prices
+}
+
 // getDashRateInUSD accepts a BTC/USD rate and a dashrates.RateInfo object and
 // returns a Dash/USD rate object.
-func getDashRateInUSD(rateBitcoinUSD float64, exchName string, info *dashrates.RateInfo) (*DashUSDRate, error) {
-	if info.BaseCurrency != "DASH" {
-		return nil, fmt.Errorf("base currency not Dash")
+//
+// The price is converted with convert.QuoteUSD: DASH/BTC prices are
+// multiplied by the BTC/USD rate, prices in USD stablecoins (USDT, USDC, BUSD)
+// by the stablecoin peg, and USD prices are used as-is. The volume is the base
+// asset (DASH) volume at the USD price, or for exchanges in volumeInQuote, the
+// quote currency volume converted to USD the same way as the price. The price
+// is rounded to PRICE_DECIMALS places and the volume to VOLUME_DECIMALS
+// places, if set, and the volume is left nil when zero. If INCLUDE_RAW is set,
+// the unconverted price and quote currency are kept too. It has no side
+// effects, and errors if the base currency isn't DASH, the quote currency
+// isn't recognized, or a BTC-quoted rate can't be converted.
+func getDashRateInUSD(rateBitcoinUSD float64, exchName string, info *dashrates.RateInfo) (*ratestore.DashUSDRate, error) {
+	// USD value of one unit of the quote currency
+	quoteUSD, err := convert.QuoteUSD(info, rateBitcoinUSD, stablecoinPeg)
+	if err != nil {
+		return nil, err
 	}
-	quoteUSD := info.LastPrice
-	if info.QuoteCurrency == "BTC" {
-		quoteUSD = info.LastPrice * rateBitcoinUSD
+	priceUSD := info.LastPrice * quoteUSD
+
+	volUSD := info.BaseAssetVolume * priceUSD
+	if volumeInQuote[exchName] {
+		volUSD = info.BaseAssetVolume * quoteUSD
 	}
-	volUSD := info.BaseAssetVolume * quoteUSD
 
+	// a volume which rounds to zero is left nil, the same as no volume
+	volUSD = roundVolume(volUSD)
 	var volPtr *float64
 	if volUSD != 0 {
 		volPtr = &volUSD
 	}
-	usdRate := &DashUSDRate{
-		Name:      exchName,
-		RateUSD:   quoteUSD,
+	name := exchanges.Canonical(exchName)
+	usdRate := &ratestore.DashUSDRate{
+		Name:      name.DisplayName,
+		Slug:      name.Slug,
+		RateUSD:   roundPrice(priceUSD),
 		VolumeUSD: volPtr,
 		FetchedAt: info.FetchTime,
+		Pair:      info.BaseCurrency + "/" + info.QuoteCurrency,
+	}
+	if includeRaw {
+		usdRate.RawPrice = info.LastPrice
+		usdRate.RawQuote = info.QuoteCurrency
 	}
 	return usdRate, nil
 }
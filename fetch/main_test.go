@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nmarley/dashrates"
+	"github.com/projects/sls-dash-rate-service/internal/convert"
+)
+
+// testBTCUSD is the BTC/USD rate the tests convert BTC-quoted prices with
+const testBTCUSD = 10000.0
+
+// testFetchTime is when the rates in the tests were fetched, recently enough
+// to be kept in the price history
+var testFetchTime = time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+
+// rateInfo returns a fetched rate for the given pair
+func rateInfo(base, quote string, price, volume float64) *dashrates.RateInfo {
+	return &dashrates.RateInfo{
+		BaseCurrency:    base,
+		QuoteCurrency:   quote,
+		LastPrice:       price,
+		BaseAssetVolume: volume,
+		FetchTime:       testFetchTime,
+	}
+}
+
+// approxEqual reports whether got is within a small tolerance of want
+func approxEqual(got, want float64) bool {
+	return math.Abs(got-want) < 1e-9
+}
+
+func TestGetDashRateInUSD(t *testing.T) {
+	tests := []struct {
+		name     string
+		exchange string
+		info     *dashrates.RateInfo
+		price    float64
+		volume   *float64
+		pair     string
+		wantErr  bool
+	}{
+		{
+			name:     "DASH/USD isn't converted",
+			exchange: "Kraken",
+			info:     rateInfo("DASH", "USD", 75.5, 0),
+			price:    75.5,
+			pair:     "DASH/USD",
+		},
+		{
+			name:     "DASH/BTC is multiplied by BTC/USD",
+			exchange: "Binance",
+			info:     rateInfo("DASH", "BTC", 0.0075, 0),
+			price:    75,
+			pair:     "DASH/BTC",
+		},
+		{
+			name:     "non-DASH base",
+			exchange: "Kraken",
+			info:     rateInfo("BTC", "USD", 10000, 0),
+			wantErr:  true,
+		},
+		{
+			name:     "zero volume is nil",
+			exchange: "Kraken",
+			info:     rateInfo("DASH", "USD", 75, 0),
+			price:    75,
+			pair:     "DASH/USD",
+		},
+		{
+			name:     "DASH volume at the USD price",
+			exchange: "Binance",
+			info:     rateInfo("DASH", "BTC", 0.0075, 200),
+			price:    75,
+			volume:   ptr(15000),
+			pair:     "DASH/BTC",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getDashRateInUSD(testBTCUSD, tt.exchange, tt.info)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("getDashRateInUSD = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !approxEqual(got.RateUSD, tt.price) {
+				t.Errorf("RateUSD = %v, want %v", got.RateUSD, tt.price)
+			}
+			switch {
+			case tt.volume == nil && got.VolumeUSD != nil:
+				t.Errorf("VolumeUSD = %v, want nil", *got.VolumeUSD)
+			case tt.volume != nil && got.VolumeUSD == nil:
+				t.Errorf("VolumeUSD = nil, want %v", *tt.volume)
+			case tt.volume != nil && !approxEqual(*got.VolumeUSD, *tt.volume):
+				t.Errorf("VolumeUSD = %v, want %v", *got.VolumeUSD, *tt.volume)
+			}
+			if got.Name != tt.exchange {
+				t.Errorf("Name = %q, want %q", got.Name, tt.exchange)
+			}
+			if got.Pair != tt.pair {
+				t.Errorf("Pair = %q, want %q", got.Pair, tt.pair)
+			}
+			if !got.FetchedAt.Equal(testFetchTime) {
+				t.Errorf("FetchedAt = %v, want %v", got.FetchedAt, testFetchTime)
+			}
+		})
+	}
+}
+
+func TestGetDashRateInUSDNoBTCUSD(t *testing.T) {
+	if _, err := getDashRateInUSD(0, "Binance", rateInfo("DASH", "BTC", 0.0075, 0)); err == nil {
+		t.Error("converted a DASH/BTC rate without a BTC/USD rate")
+	}
+	// USD prices don't need the BTC/USD rate
+	if _, err := getDashRateInUSD(0, "Kraken", rateInfo("DASH", "USD", 75, 0)); err != nil {
+		t.Errorf("DASH/USD without a BTC/USD rate: %v", err)
+	}
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
+
+func TestGetDashRateInUSDCoinbase(t *testing.T) {
+	// Coinbase quotes DASH in USD, so the BTC/USD rate mustn't be applied
+	// however large it is
+	for _, btcUSD := range []float64{0, testBTCUSD} {
+		got, err := getDashRateInUSD(btcUSD, "Coinbase", rateInfo("DASH", "USD", 75.25, 0))
+		if err != nil {
+			t.Fatalf("btcUSD %v: %v", btcUSD, err)
+		}
+		if got.RateUSD != 75.25 {
+			t.Errorf("btcUSD %v: RateUSD = %v, want 75.25", btcUSD, got.RateUSD)
+		}
+		if got.Name != "Coinbase" || got.Slug != "coinbase" || got.Pair != "DASH/USD" {
+			t.Errorf("btcUSD %v: got %s (%s) %s, want Coinbase (coinbase) DASH/USD", btcUSD, got.Name, got.Slug, got.Pair)
+		}
+	}
+}
+
+func TestGetDashRateInUSDVolumeConvention(t *testing.T) {
+	tests := []struct {
+		name     string
+		exchange string
+		info     *dashrates.RateInfo
+		volume   float64
+	}{
+		// 200 DASH at $75
+		{"DASH volume, BTC quote", "Binance", rateInfo("DASH", "BTC", 0.0075, 200), 15000},
+		{"DASH volume, USD quote", "Kraken", rateInfo("DASH", "USD", 75, 200), 15000},
+		// Digifinex reports 15000 USDT of volume, already in the quote
+		{"quote volume, stablecoin quote", "Digifinex", rateInfo("DASH", "USDT", 75, 15000), 15000},
+		// and 1.5 BTC of volume, at $10000
+		{"quote volume, BTC quote", "Digifinex", rateInfo("DASH", "BTC", 0.0075, 1.5), 15000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getDashRateInUSD(testBTCUSD, tt.exchange, tt.info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.VolumeUSD == nil || !approxEqual(*got.VolumeUSD, tt.volume) {
+				t.Errorf("VolumeUSD = %v, want %v", got.VolumeUSD, tt.volume)
+			}
+			if !approxEqual(got.RateUSD, 75) {
+				t.Errorf("RateUSD = %v, want 75", got.RateUSD)
+			}
+		})
+	}
+}
+
+func TestGetDashRateInUSDUnsupportedPair(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    *dashrates.RateInfo
+		wantErr error
+	}{
+		{"non-DASH base", rateInfo("BTC", "USD", 10000, 0), convert.ErrBaseNotDash},
+		{"unknown quote", rateInfo("DASH", "EUR", 70, 0), convert.ErrUnknownQuote},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := getDashRateInUSD(testBTCUSD, "Kraken", tt.info)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got := conversionCategory(err); got != failUnsupportedPair {
+				t.Errorf("conversionCategory = %q, want %q", got, failUnsupportedPair)
+			}
+		})
+	}
+
+	// other conversion failures aren't reported as unsupported pairs
+	_, err := getDashRateInUSD(0, "Binance", rateInfo("DASH", "BTC", 0.0075, 0))
+	if got := conversionCategory(err); got != failConversion {
+		t.Errorf("conversionCategory(%v) = %q, want %q", err, got, failConversion)
+	}
+}
+
+func TestConvertAll(t *testing.T) {
+	tests := []struct {
+		name   string
+		btcUSD float64
+		infos  map[string]*dashrates.RateInfo
+		// want are the converted exchanges in order, and errs the categories
+		// of the failures
+		want []string
+		errs map[string]string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:   "all succeed, sorted by name",
+			btcUSD: testBTCUSD,
+			infos: map[string]*dashrates.RateInfo{
+				"Kraken":   rateInfo("DASH", "USD", 75, 0),
+				"Binance":  rateInfo("DASH", "BTC", 0.0075, 0),
+				"Bitfinex": rateInfo("DASH", "USDT", 75, 0),
+			},
+			want: []string{"Binance", "Bitfinex", "Kraken"},
+		},
+		{
+			name:   "all fail",
+			btcUSD: testBTCUSD,
+			infos: map[string]*dashrates.RateInfo{
+				"Kraken":  rateInfo("BTC", "USD", 10000, 0),
+				"Binance": rateInfo("DASH", "EUR", 70, 0),
+			},
+			errs: map[string]string{"Kraken": failUnsupportedPair, "Binance": failUnsupportedPair},
+		},
+		{
+			name:   "mixed",
+			btcUSD: testBTCUSD,
+			infos: map[string]*dashrates.RateInfo{
+				"Kraken":   rateInfo("DASH", "USD", 75, 0),
+				"Binance":  rateInfo("DASH", "BTC", 0.0075, 0),
+				"Bitfinex": rateInfo("ETH", "USD", 200, 0),
+				"Poloniex": rateInfo("DASH", "EUR", 70, 0),
+				"Huobi":    rateInfo("DASH", "USD", 0, 0),
+				"Yobit":    rateInfo("DASH", "USD", math.NaN(), 0),
+				"Exmo":     rateInfo("DASH", "USD", 75, math.Inf(1)),
+			},
+			want: []string{"Binance", "Kraken"},
+			errs: map[string]string{
+				"Bitfinex": failUnsupportedPair,
+				"Poloniex": failUnsupportedPair,
+				"Huobi":    failInvalidRate,
+				"Yobit":    failInvalidRate,
+				"Exmo":     failInvalidRate,
+			},
+		},
+		{
+			name: "BTC quote without BTC/USD",
+			infos: map[string]*dashrates.RateInfo{
+				"Kraken":  rateInfo("DASH", "USD", 75, 0),
+				"Binance": rateInfo("DASH", "BTC", 0.0075, 0),
+			},
+			want: []string{"Kraken"},
+			errs: map[string]string{"Binance": failConversion},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := convertAll(tt.btcUSD, tt.infos)
+			if len(got) != len(tt.want) {
+				t.Fatalf("converted %d rates, want %v", len(got), tt.want)
+			}
+			for i, name := range tt.want {
+				if got[i].Name != name {
+					t.Errorf("rate %d is %s, want %s", i, got[i].Name, name)
+				}
+			}
+			if len(errs) != len(tt.errs) {
+				t.Errorf("errors = %v, want failures of %v", errs, tt.errs)
+			}
+			for name, category := range tt.errs {
+				err, ok := errs[name]
+				if !ok {
+					t.Errorf("no error for %s", name)
+					continue
+				}
+				if got := conversionCategory(err); got != category {
+					t.Errorf("%s: category of %v = %q, want %q", name, err, got, category)
+				}
+			}
+		})
+	}
+}
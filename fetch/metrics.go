@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// metricsNamespace is the CloudWatch namespace fetch metrics are published to
+const metricsNamespace = "DashRateService"
+
+// emfMetric describes one metric in a CloudWatch Embedded Metric Format
+// document
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// emitMetrics writes a CloudWatch Embedded Metric Format log line with the
+// duration and outcome of a fetch run, which CloudWatch turns into metrics
+// without any PutMetricData calls. It's written straight to stdout so that it
+// doesn't depend on the log level, and so the line is the bare EMF document.
+func emitMetrics(duration time.Duration, summary fetchSummary) {
+	doc := map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  metricsNamespace,
+				"Dimensions": [][]string{{"Function"}},
+				"Metrics": []emfMetric{
+					{Name: "FetchDuration", Unit: "Milliseconds"},
+					{Name: "ExchangesAttempted", Unit: "Count"},
+					{Name: "ExchangesSucceeded", Unit: "Count"},
+					{Name: "RedisWrites", Unit: "Count"},
+				},
+			}},
+		},
+		"Function":           "fetch",
+		"FetchDuration":      duration.Milliseconds(),
+		"ExchangesAttempted": summary.Attempted,
+		"ExchangesSucceeded": summary.Succeeded,
+		"RedisWrites":        summary.RedisWrites,
+	}
+	line, err := json.Marshal(doc)
+	if err != nil {
+		slog.Warn("unable to marshal metrics", "error", err)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(line))
+}
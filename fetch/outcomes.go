@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// recordOutcomes appends the outcome of this run's fetch from each exchange to
+// its list of recent outcomes, given the error (nil on success) and fetch time
+// in milliseconds of each, and trims each list to the most recent
+// ratestore.MaxOutcomes.
+func recordOutcomes(redisCli *redis.Client, fetchErrs map[string]error, fetchMs map[string]int64) {
+	now := time.Now()
+	pipe := redisCli.Pipeline()
+	for name, err := range fetchErrs {
+		outcome := &ratestore.FetchOutcome{At: now, OK: err == nil, FetchMs: fetchMs[name]}
+		if err != nil {
+			outcome.Error = err.Error()
+		}
+		key := ratestore.OutcomesKey(name)
+		pipe.LPush(key, outcome)
+		pipe.LTrim(key, 0, ratestore.MaxOutcomes-1)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		slog.Warn("unable to record fetch outcomes", "error", err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/push"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// pushRates pushes the stored rates to every connected WebSocket client if
+// WEBSOCKET_ENDPOINT is set. Failures are only logged, as the rates are
+// already stored.
+func pushRates(ctx context.Context, redisCli *redis.Client, rates []ratestore.DashUSDRate) {
+	endpoint := push.Endpoint()
+	if endpoint == "" {
+		return
+	}
+	msg, err := push.RatesMessage(rates)
+	if err != nil {
+		slog.Warn("unable to marshal rates update", "error", err)
+		return
+	}
+	sent, err := push.Broadcast(ctx, redisCli, endpoint, msg)
+	if err != nil {
+		slog.Warn("unable to push rates to websocket clients", "error", err)
+		return
+	}
+	slog.Info("pushed rates to websocket clients", "clients", sent)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/outbound"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// defaultRateLimitCooldownSec is how long a provider is left alone after it
+// rate limits a fetch when RATE_LIMIT_COOLDOWN_SEC is unset
+const defaultRateLimitCooldownSec = 300
+
+// rateLimitBackoff is set once at startup from RATE_LIMIT_BACKOFF. When set,
+// a provider which rate limits a fetch, see outbound.ErrRateLimited, is
+// skipped by every exchange it serves until its cooldown expires.
+var rateLimitBackoff bool
+
+// rateLimitKey is the Redis key which exists, until the cooldown expires it,
+// while a provider is rate limiting us
+func rateLimitKey(host string) string {
+	return ratestore.MetaKey("ratelimit:" + host)
+}
+
+// rateLimitedHosts returns those of the given hosts whose cooldown hasn't
+// expired.
+func rateLimitedHosts(redisCli *redis.Client, hosts []string) (map[string]bool, error) {
+	pipe := redisCli.Pipeline()
+	cmds := make([]*redis.IntCmd, len(hosts))
+	for i, host := range hosts {
+		cmds[i] = pipe.Exists(rateLimitKey(host))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	limited := make(map[string]bool)
+	for i, host := range hosts {
+		if cmds[i].Val() > 0 {
+			limited[host] = true
+		}
+	}
+	return limited, nil
+}
+
+// recordRateLimits starts the cooldown of the provider of each exchange whose
+// fetch was rate limited. hosts maps exchange names to their provider's host.
+func recordRateLimits(redisCli *redis.Client, fetchErrs map[string]error, hosts map[string]string) {
+	cooldown := time.Duration(ratestore.EnvInt("RATE_LIMIT_COOLDOWN_SEC", defaultRateLimitCooldownSec)) * time.Second
+	pipe := redisCli.Pipeline()
+	queued := 0
+	for name, err := range fetchErrs {
+		host := hosts[name]
+		if host == "" || !errors.Is(err, outbound.ErrRateLimited) {
+			continue
+		}
+		slog.Warn("rate limited, backing off provider", "exchange", name, "host", host, "cooldown", cooldown)
+		pipe.Set(rateLimitKey(host), name, cooldown)
+		queued++
+	}
+	if queued == 0 {
+		return
+	}
+	if _, err := pipe.Exec(); err != nil {
+		slog.Warn("unable to record rate limits", "error", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// priceSanityPct is how far, in percent, a rate's price may be from the median
+// of the batch before it's rejected, or 0 to disable the check. It's set once
+// at startup from PRICE_SANITY_PCT.
+var priceSanityPct float64
+
+// parsePriceSanityPct returns the sanity band from the PRICE_SANITY_PCT env
+// var, or 0 (disabled) if it's unset or not a positive number.
+func parsePriceSanityPct() float64 {
+	pct := ratestore.EnvFloat("PRICE_SANITY_PCT", 0)
+	if pct < 0 || math.IsNaN(pct) || math.IsInf(pct, 0) {
+		slog.Warn("PRICE_SANITY_PCT must be a positive number, disabling", "value", pct)
+		return 0
+	}
+	return pct
+}
+
+// applySanityBand splits the converted rates into those whose price is within
+// pct percent of the median price, and the errors rejecting the rest, keyed by
+// exchange. Nothing is rejected if pct <= 0 or there are fewer than three
+// rates, as there's no meaningful consensus.
+func applySanityBand(rates []ratestore.DashUSDRate, pct float64) ([]ratestore.DashUSDRate, map[string]error) {
+	if pct <= 0 || len(rates) < 3 {
+		return rates, nil
+	}
+
+	prices := make([]float64, len(rates))
+	for i, rate := range rates {
+		prices[i] = rate.RateUSD
+	}
+	sort.Float64s(prices)
+	median := prices[len(prices)/2]
+	if len(prices)%2 == 0 {
+		median = (prices[len(prices)/2-1] + median) / 2
+	}
+
+	var kept []ratestore.DashUSDRate
+	rejected := make(map[string]error)
+	for _, rate := range rates {
+		deviation := math.Abs(rate.RateUSD-median) / median * 100
+		if deviation > pct {
+			rejected[rate.Name] = fmt.Errorf("price %v is %.1f%% from the median %v, over the %v%% limit",
+				rate.RateUSD, deviation, median, pct)
+			continue
+		}
+		kept = append(kept, rate)
+	}
+	return kept, rejected
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// putRates puts the converted rates in store in one batch, recording each
+// failure in summary, and returns the rates which were stored. Writes to Redis
+// are counted as such, so that Redis being down can be told apart from a
+// single bad write.
+func putRates(ctx context.Context, store ratestore.RateStore, rates []ratestore.DashUSDRate, isRedis bool, summary *fetchSummary) []ratestore.DashUSDRate {
+	errs := store.PutAll(ctx, rates, rateTTL)
+
+	var stored []ratestore.DashUSDRate
+	for _, rate := range rates {
+		err := errs[rate.Name]
+		switch {
+		case isRedis:
+			if !summary.recordWrite(rate.Name, "set", err) {
+				continue
+			}
+		case err != nil:
+			summary.addError(rate.Name, failStore, err)
+			continue
+		}
+		summary.Stored++
+		stored = append(stored, rate)
+	}
+	return stored
+}
+
+// storeExtras writes what Redis keeps alongside the rates in a single
+// round-trip: the BTC/USD and FX rates, unless fetching them failed, and the
+// price history of each stored rate. Outcomes are recorded in summary.
+func storeExtras(ctx context.Context, redisCli *redis.Client, stored []ratestore.DashUSDRate,
+	btcUSD float64, btcFetchedAt time.Time, btcErr error,
+	fxRates map[string]float64, fxErr error, summary *fetchSummary) {
+	pipe := redisCli.WithContext(ctx).TxPipeline()
+	var btcCmd, btcFetchedAtCmd, fxCmd *redis.StatusCmd
+	if btcErr == nil {
+		btcCmd = pipe.Set(ratestore.MetaKey("btcusd"), btcUSD, rateTTL)
+		btcFetchedAtCmd = pipe.Set(ratestore.MetaKey("btcusdFetchedAt"),
+			btcFetchedAt.UTC().Format(time.RFC3339Nano), rateTTL)
+	}
+	if fxErr == nil {
+		var err error
+		if fxCmd, err = storeFXRates(pipe, fxRates); err != nil {
+			summary.addError("FX", failRedis, fmt.Errorf("redis set err: %v", err))
+		}
+	}
+	historyCmds := make([][]redis.Cmder, len(stored))
+	for i := range stored {
+		cmds, err := storeHistory(pipe, &stored[i])
+		if err != nil {
+			summary.addError(stored[i].Name, failRedis, fmt.Errorf("redis history err: %v", err))
+		}
+		historyCmds[i] = cmds
+	}
+	// errors are checked per command below, as in RedisStore.PutAll
+	_, _ = pipe.Exec()
+
+	if btcCmd != nil {
+		summary.recordWrite("BTC/USD", "set", btcCmd.Err())
+		summary.recordWrite("BTC/USD", "set", btcFetchedAtCmd.Err())
+	}
+	if fxCmd != nil {
+		summary.recordWrite("FX", "set", fxCmd.Err())
+	}
+	for i := range stored {
+		for _, cmd := range historyCmds[i] {
+			if !summary.recordWrite(stored[i].Name, "history", cmd.Err()) {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+
+	"github.com/projects/sls-dash-rate-service/internal/logging"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+// HealthHandler is our lambda handler invoked by the `lambda.Start` function
+// call. It checks that the Redis connection is alive without fetching or
+// reading any rates.
+func HealthHandler(ctx context.Context) (Response, error) {
+	status := healthStatus{Status: "ok", Redis: true}
+	statusCode := 200
+
+	if err := checkRedis(); err != nil {
+		slog.Error("health check failed", "error", err)
+		status = healthStatus{Status: "error", Redis: false}
+		statusCode = 503
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		return Response{StatusCode: 500}, err
+	}
+	resp := Response{
+		StatusCode:      statusCode,
+		IsBase64Encoded: false,
+		Body:            string(body),
+		Headers: map[string]string{
+			"Content-Type":           "application/json",
+			"X-MyCompany-Func-Reply": "health-handler",
+		},
+	}
+
+	return resp, nil
+}
+
+func main() {
+	logging.Setup()
+	lambda.Start(HealthHandler)
+}
+
+// healthStatus is the body returned by the health handler
+type healthStatus struct {
+	Status string `json:"status"`
+	Redis  bool   `json:"redis"`
+}
+
+// checkRedis ensures the Redis connection is configured and responds to PING
+func checkRedis() error {
+	// ensure required environment variables set
+	if err := ratestore.EnvCheck([]string{"REDIS_URL"}); err != nil {
+		return err
+	}
+
+	// get the shared redis connection, which does the PING
+	_, err := ratestore.RedisClient(os.Getenv("REDIS_URL"))
+	return err
+}
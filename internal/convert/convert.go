@@ -0,0 +1,87 @@
+// Package convert converts the DASH prices fetched from exchanges to USD. It's
+// shared by fetch, which stores the converted rates, and admin, which compares
+// fresh prices with them, so that both convert prices the same way.
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+
+	"github.com/nmarley/dashrates"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// quoteKind is how prices in a quote currency are converted to USD
+type quoteKind int
+
+const (
+	// quoteUSD prices are already USD
+	quoteUSD quoteKind = iota
+	// quoteBTC prices are multiplied by the BTC/USD rate
+	quoteBTC
+	// quoteStablecoin prices are multiplied by the stablecoin peg
+	quoteStablecoin
+)
+
+// recognizedQuotes are the quote currencies which exchange rates can be
+// converted to USD from. Rates in any other quote currency are rejected.
+var recognizedQuotes = map[string]quoteKind{
+	"USD":  quoteUSD,
+	"BTC":  quoteBTC,
+	"USDT": quoteStablecoin,
+	"USDC": quoteStablecoin,
+	"BUSD": quoteStablecoin,
+}
+
+// ErrBaseNotDash is returned for a rate whose base currency isn't DASH
+var ErrBaseNotDash = errors.New("base currency not Dash")
+
+// ErrUnknownQuote is returned for a rate whose quote currency isn't one which
+// can be converted to USD
+var ErrUnknownQuote = errors.New("unrecognized quote currency")
+
+// QuoteUSD returns the USD value of one unit of info's quote currency: 1 for
+// USD, btcUSD for BTC, and stablecoinPeg for USD stablecoins (USDT, USDC,
+// BUSD). It errors if the base currency isn't DASH, the quote currency isn't
+// recognized, or the quote is BTC and btcUSD is zero, i.e. unavailable.
+func QuoteUSD(info *dashrates.RateInfo, btcUSD, stablecoinPeg float64) (float64, error) {
+	if info.BaseCurrency != "DASH" {
+		return 0, fmt.Errorf("%w: %q", ErrBaseNotDash, info.BaseCurrency)
+	}
+	kind, ok := recognizedQuotes[info.QuoteCurrency]
+	if !ok {
+		return 0, fmt.Errorf("%w %q", ErrUnknownQuote, info.QuoteCurrency)
+	}
+	switch kind {
+	case quoteBTC:
+		if btcUSD == 0 {
+			return 0, fmt.Errorf("BTC/USD rate not available")
+		}
+		return btcUSD, nil
+	case quoteStablecoin:
+		return stablecoinPeg, nil
+	}
+	return 1, nil
+}
+
+// PriceUSD returns info's DASH price in USD, converted with QuoteUSD.
+func PriceUSD(info *dashrates.RateInfo, btcUSD, stablecoinPeg float64) (float64, error) {
+	quote, err := QuoteUSD(info, btcUSD, stablecoinPeg)
+	if err != nil {
+		return 0, err
+	}
+	return info.LastPrice * quote, nil
+}
+
+// ParseStablecoinPeg returns the USD value of one unit of a USD stablecoin from
+// the STABLECOIN_PEG env var, falling back to 1 if it isn't a positive number.
+func ParseStablecoinPeg() float64 {
+	peg := ratestore.EnvFloat("STABLECOIN_PEG", 1)
+	if peg <= 0 || math.IsNaN(peg) || math.IsInf(peg, 0) {
+		slog.Warn("STABLECOIN_PEG must be a positive number, using default", "value", peg, "default", 1)
+		peg = 1
+	}
+	return peg
+}
@@ -0,0 +1,48 @@
+package convert
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nmarley/dashrates"
+)
+
+func TestQuoteUSD(t *testing.T) {
+	tests := []struct {
+		base, quote string
+		btcUSD      float64
+		want        float64
+		wantErr     error
+	}{
+		{"DASH", "USD", 10000, 1, nil},
+		{"DASH", "BTC", 10000, 10000, nil},
+		{"DASH", "USDT", 10000, 0.99, nil},
+		{"DASH", "BUSD", 0, 0.99, nil},
+		{"BTC", "USD", 10000, 0, ErrBaseNotDash},
+		{"DASH", "EUR", 10000, 0, ErrUnknownQuote},
+		{"DASH", "ETH", 10000, 0, ErrUnknownQuote},
+	}
+	for _, tt := range tests {
+		info := &dashrates.RateInfo{BaseCurrency: tt.base, QuoteCurrency: tt.quote, LastPrice: 75}
+		got, err := QuoteUSD(info, tt.btcUSD, 0.99)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s/%s: err = %v, want %v", tt.base, tt.quote, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s/%s: QuoteUSD = %v, want %v", tt.base, tt.quote, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteUSDNoBTCUSD(t *testing.T) {
+	info := &dashrates.RateInfo{BaseCurrency: "DASH", QuoteCurrency: "BTC", LastPrice: 0.0075}
+	_, err := QuoteUSD(info, 0, 1)
+	if err == nil {
+		t.Fatal("converted a BTC quote without a BTC/USD rate")
+	}
+	// a missing BTC/USD rate isn't an unsupported pair
+	if errors.Is(err, ErrBaseNotDash) || errors.Is(err, ErrUnknownQuote) {
+		t.Errorf("err = %v, want neither ErrBaseNotDash nor ErrUnknownQuote", err)
+	}
+}
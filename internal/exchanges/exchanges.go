@@ -0,0 +1,101 @@
+// Package exchanges holds the set of exchanges which Dash rates are fetched
+// from, so that it's shared by the fetch function and anything describing it.
+package exchanges
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/nmarley/dashrates"
+)
+
+// constructors create a dashrates.RateAPI for each exchange rates can be
+// fetched from, in the default order
+var constructors = []func() dashrates.RateAPI{
+	func() dashrates.RateAPI { return dashrates.NewBinanceAPI() },
+	func() dashrates.RateAPI { return dashrates.NewKrakenAPI() },
+	func() dashrates.RateAPI { return dashrates.NewBitfinexAPI() },
+	func() dashrates.RateAPI { return dashrates.NewPoloniexAPI() },
+	func() dashrates.RateAPI { return dashrates.NewHuobiAPI() },
+	func() dashrates.RateAPI { return dashrates.NewBittrexAPI() },
+	func() dashrates.RateAPI { return dashrates.NewLivecoinAPI() },
+	func() dashrates.RateAPI { return dashrates.NewExmoAPI() },
+	func() dashrates.RateAPI { return dashrates.NewHitBTCAPI() },
+	func() dashrates.RateAPI { return dashrates.NewYobitAPI() },
+	func() dashrates.RateAPI { return dashrates.NewCexAPI() },
+	func() dashrates.RateAPI { return dashrates.NewBigONEAPI() },
+	func() dashrates.RateAPI { return dashrates.NewCoinbaseProAPI() },
+	func() dashrates.RateAPI { return dashrates.NewCoinbaseAPI() },
+	func() dashrates.RateAPI { return dashrates.NewDigifinexAPI() },
+}
+
+// All returns a dashrates.RateAPI for every known exchange.
+func All() []dashrates.RateAPI {
+	apis := make([]dashrates.RateAPI, len(constructors))
+	for i, newAPI := range constructors {
+		apis[i] = newAPI()
+	}
+	return apis
+}
+
+// Enabled returns a dashrates.RateAPI for each exchange named in the
+// ENABLED_EXCHANGES env var, a comma-separated list of display names matched
+// case-insensitively, or slugs. If it's unset, every known exchange is
+// enabled. Unknown names are logged and ignored.
+func Enabled() []dashrates.RateAPI {
+	val := os.Getenv("ENABLED_EXCHANGES")
+	if strings.TrimSpace(val) == "" {
+		return All()
+	}
+
+	reg := registry()
+	var apis []dashrates.RateAPI
+	for _, name := range strings.Split(val, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		newAPI, ok := reg[strings.ToLower(name)]
+		if !ok {
+			slog.Warn("unknown exchange in ENABLED_EXCHANGES, ignoring", "exchange", name)
+			continue
+		}
+		apis = append(apis, newAPI())
+	}
+	return apis
+}
+
+// Names returns the canonical display name of each enabled exchange.
+func Names() []string {
+	apis := Enabled()
+	names := make([]string, len(apis))
+	for i, api := range apis {
+		names[i] = Canonical(api.DisplayName()).DisplayName
+	}
+	return names
+}
+
+// Lookup returns the canonical display name of the known exchange whose
+// display name (case-insensitively) or slug matches name, and whether there is
+// one.
+func Lookup(name string) (string, bool) {
+	newAPI, ok := registry()[strings.ToLower(name)]
+	if !ok {
+		return "", false
+	}
+	return Canonical(newAPI().DisplayName()).DisplayName, true
+}
+
+// registry maps the lower-cased display name and the slug of each known
+// exchange to its constructor.
+func registry() map[string]func() dashrates.RateAPI {
+	reg := make(map[string]func() dashrates.RateAPI, 2*len(constructors))
+	for _, newAPI := range constructors {
+		name := Canonical(newAPI().DisplayName())
+		reg[strings.ToLower(newAPI().DisplayName())] = newAPI
+		reg[strings.ToLower(name.DisplayName)] = newAPI
+		reg[name.Slug] = newAPI
+	}
+	return reg
+}
@@ -0,0 +1,61 @@
+package exchanges
+
+import "strings"
+
+// Name is the canonical naming of an exchange: a stable slug, used in Redis
+// keys and accepted by the API, and the human-readable display name returned
+// to clients
+type Name struct {
+	Slug        string
+	DisplayName string
+}
+
+// canonicalNames maps the display name dashrates reports for each exchange,
+// and any other spelling of it, to its canonical name. Pinning them here
+// keeps Redis keys and API names from drifting if dashrates renames an
+// exchange: add the new spelling, mapped to the existing name.
+var canonicalNames = map[string]Name{
+	"BigONE":       {"bigone", "BigONE"},
+	"Binance":      {"binance", "Binance"},
+	"Bitfinex":     {"bitfinex", "Bitfinex"},
+	"Bittrex":      {"bittrex", "Bittrex"},
+	"CEX.IO":       {"cexio", "CEX.IO"},
+	"Coinbase":     {"coinbase", "Coinbase"},
+	"Coinbase Pro": {"coinbasepro", "Coinbase Pro"},
+	"Digifinex":    {"digifinex", "Digifinex"},
+	"Exmo":         {"exmo", "Exmo"},
+	"HitBTC":       {"hitbtc", "HitBTC"},
+	"Hit BTC":      {"hitbtc", "HitBTC"},
+	"Huobi":        {"huobi", "Huobi"},
+	"Kraken":       {"kraken", "Kraken"},
+	"Livecoin":     {"livecoin", "Livecoin"},
+	"Poloniex":     {"poloniex", "Poloniex"},
+	"Yobit":        {"yobit", "Yobit"},
+}
+
+// Canonical returns the canonical name of the exchange with the given display
+// name. An exchange missing from the table keeps its display name, and its
+// slug is the display name lower-cased with anything other than letters and
+// digits removed.
+func Canonical(displayName string) Name {
+	if name, ok := canonicalNames[displayName]; ok {
+		return name
+	}
+	return Name{Slug: slugify(displayName), DisplayName: displayName}
+}
+
+// Slug returns the slug of the exchange with the given display name.
+func Slug(displayName string) string {
+	return Canonical(displayName).Slug
+}
+
+// slugify lower-cases s and drops anything other than letters and digits
+func slugify(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,29 @@
+package exchanges
+
+// providers maps the slug of each exchange to the host its rate is fetched
+// from, which identifies the provider for rate limiting: a provider which
+// rate limits one exchange's fetch is left alone by every exchange it serves.
+// Keep it in step with the URLs of the dashrates APIs in constructors.
+var providers = map[string]string{
+	"bigone":      "big.one",
+	"binance":     "api.binance.com",
+	"bitfinex":    "api.bitfinex.com",
+	"bittrex":     "api.bittrex.com",
+	"cexio":       "cex.io",
+	"coinbase":    "api.coinbase.com",
+	"coinbasepro": "api.pro.coinbase.com",
+	"digifinex":   "openapi.digifinex.com",
+	"exmo":        "api.exmo.com",
+	"hitbtc":      "api.hitbtc.com",
+	"huobi":       "api.huobi.pro",
+	"kraken":      "api.kraken.com",
+	"livecoin":    "api.livecoin.net",
+	"poloniex":    "poloniex.com",
+	"yobit":       "yobit.net",
+}
+
+// Provider returns the host the exchange with the given display name is
+// fetched from, or "" if it isn't known.
+func Provider(displayName string) string {
+	return providers[Canonical(displayName).Slug]
+}
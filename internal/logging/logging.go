@@ -0,0 +1,26 @@
+// Package logging configures structured JSON logging for the Lambda
+// functions, so log lines can be queried with CloudWatch Logs Insights and
+// matched by metric filters.
+package logging
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Setup makes a JSON logger writing to stderr the default slog logger. The
+// minimum level logged is taken from the LOG_LEVEL env var (debug, info, warn
+// or error), and defaults to info.
+func Setup() {
+	var level slog.Level
+	val := os.Getenv("LOG_LEVEL")
+	if val != "" {
+		if err := level.UnmarshalText([]byte(val)); err != nil {
+			level = slog.LevelInfo
+			defer slog.Warn("invalid LOG_LEVEL, using info", "value", val)
+		}
+	}
+
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(handler))
+}
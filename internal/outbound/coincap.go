@@ -0,0 +1,58 @@
+package outbound
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nmarley/dashrates"
+)
+
+// CoinCapAPI returns the CoinCap API client, pointed at COINCAP_URL if set,
+// e.g. to test against a mock.
+func CoinCapAPI() *dashrates.CoinCapAPI {
+	api := dashrates.NewCoinCapAPI()
+	if baseURL := os.Getenv("COINCAP_URL"); baseURL != "" {
+		api.BaseAPIURL = strings.TrimSuffix(baseURL, "/")
+	}
+	return api
+}
+
+// withCoinCapAPIKey wraps next to make requests to CoinCap carry the API key
+// in COINCAP_API_KEY, for higher rate limits. next is returned as is if no key
+// is set.
+func withCoinCapAPIKey(next http.RoundTripper) http.RoundTripper {
+	key := os.Getenv("COINCAP_API_KEY")
+	if key == "" {
+		return next
+	}
+	u, err := url.Parse(CoinCapAPI().BaseAPIURL)
+	if err != nil {
+		slog.Warn("invalid CoinCap URL, not using API key", "error", err)
+		return next
+	}
+	return &apiKeyTransport{
+		host: u.Host,
+		key:  key,
+		next: next,
+	}
+}
+
+// apiKeyTransport adds a bearer token to requests to a single host
+type apiKeyTransport struct {
+	host string
+	key  string
+	next http.RoundTripper
+}
+
+// RoundTrip is part of the http.RoundTripper interface
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == t.host {
+		// a RoundTripper mustn't modify the request it's given
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+t.key)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,77 @@
+// Package outbound builds the HTTP client requests to exchanges and rate
+// sources are made with, and fetches exchange rates with a timeout. It's
+// shared by fetch and admin, so that a live fetch made to check the cached
+// rates goes out the same way as the fetch which cached them.
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nmarley/dashrates"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// DefaultPerExchangeTimeout is how long a single exchange fetch may take when
+// PER_EXCHANGE_TIMEOUT_MS is unset
+const DefaultPerExchangeTimeout = 3000 * time.Millisecond
+
+// Setup makes ExchangeClient the default HTTP client, as dashrates makes its
+// requests with http.Get and can't be given a client of its own. Anything else
+// making requests, such as AWS clients, must use a client of its own too,
+// rather than the default one. It should be called once, at startup.
+func Setup() {
+	http.DefaultClient = ExchangeClient()
+}
+
+// ExchangeClient returns the HTTP client for requests to exchanges and rate
+// sources. They go through EXCHANGE_PROXY_URL if set, carry the User-Agent
+// from HTTP_USER_AGENT and the CoinCap API key from COINCAP_API_KEY, and if
+// RATE_LIMIT_BACKOFF is set, 429 responses surface as ErrRateLimited.
+func ExchangeClient() *http.Client {
+	var transport http.RoundTripper = exchangeTransport()
+	transport = withUserAgent(transport)
+	transport = withCoinCapAPIKey(transport)
+	transport = withRateLimitDetection(transport)
+	return &http.Client{Transport: transport}
+}
+
+// PerExchangeTimeout returns how long a single exchange fetch may take before
+// it's abandoned, from the PER_EXCHANGE_TIMEOUT_MS env var.
+func PerExchangeTimeout() time.Duration {
+	defaultMS := int(DefaultPerExchangeTimeout / time.Millisecond)
+	return time.Duration(ratestore.EnvInt("PER_EXCHANGE_TIMEOUT_MS", defaultMS)) * time.Millisecond
+}
+
+// FetchRate calls FetchRate on the given API, giving up once ctx is done or
+// timeout has passed, whichever is first.
+//
+// dashrates.RateAPI has no notion of a context, so the call itself can't be
+// cancelled. If it takes too long, the call is abandoned and its eventual
+// result discarded.
+func FetchRate(ctx context.Context, api dashrates.RateAPI, timeout time.Duration) (*dashrates.RateInfo, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	type fetchResult struct {
+		rate *dashrates.RateInfo
+		err  error
+	}
+	// buffered so the abandoned goroutine can always send and exit
+	done := make(chan fetchResult, 1)
+	go func() {
+		rate, err := api.FetchRate()
+		done <- fetchResult{rate, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.rate, res.err
+	case <-timer.C:
+		return nil, fmt.Errorf("fetch abandoned: timed out after %v", timeout)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("fetch abandoned: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,30 @@
+package outbound
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// exchangeTransport returns a copy of the default transport for requests to
+// exchanges, which routes them through the proxy given by EXCHANGE_PROXY_URL,
+// e.g. when exchanges geo-block the region the functions run in. Without it,
+// the transport honors HTTP_PROXY, HTTPS_PROXY and NO_PROXY as usual. Other
+// clients, such as the AWS ones, keep using the default transport, so they're
+// never proxied.
+func exchangeTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	raw := os.Getenv("EXCHANGE_PROXY_URL")
+	if raw == "" {
+		return transport
+	}
+	proxyURL, err := url.Parse(raw)
+	if err != nil || proxyURL.Host == "" {
+		slog.Error("ignoring invalid EXCHANGE_PROXY_URL", "error", err)
+		return transport
+	}
+	transport.Proxy = http.ProxyURL(proxyURL)
+	slog.Info("proxying exchange requests", "proxy", proxyURL.Redacted())
+	return transport
+}
@@ -0,0 +1,37 @@
+package outbound
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// ErrRateLimited is returned when a provider answers with 429 Too Many
+// Requests
+var ErrRateLimited = errors.New("rate limited (429 Too Many Requests)")
+
+// withRateLimitDetection wraps next to make 429 responses surface as
+// ErrRateLimited when RATE_LIMIT_BACKOFF is set. dashrates ignores the status
+// code, so a 429 would otherwise show up as a parse error.
+func withRateLimitDetection(next http.RoundTripper) http.RoundTripper {
+	if !ratestore.EnvBool("RATE_LIMIT_BACKOFF") {
+		return next
+	}
+	return &rateLimitTransport{next: next}
+}
+
+// rateLimitTransport turns 429 responses into ErrRateLimited
+type rateLimitTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip is part of the http.RoundTripper interface
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	resp.Body.Close()
+	return nil, ErrRateLimited
+}
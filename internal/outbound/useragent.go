@@ -0,0 +1,40 @@
+package outbound
+
+import (
+	"net/http"
+	"os"
+)
+
+// defaultUserAgent identifies this service to exchanges when HTTP_USER_AGENT
+// is unset
+const defaultUserAgent = "sls-dash-rate-service (+https://github.com/nmarley/sls-dash-rate-service)"
+
+// withUserAgent wraps next to send the User-Agent from HTTP_USER_AGENT, or
+// defaultUserAgent, with every request, as some exchanges block Go's default
+// one. dashrates doesn't expose its headers, so this is done by the transport.
+func withUserAgent(next http.RoundTripper) http.RoundTripper {
+	userAgent := os.Getenv("HTTP_USER_AGENT")
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	return &userAgentTransport{
+		userAgent: userAgent,
+		next:      next,
+	}
+}
+
+// userAgentTransport sets the User-Agent of requests which don't have one
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+// RoundTrip is part of the http.RoundTripper interface
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		// a RoundTripper mustn't modify the request it's given
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,162 @@
+// Package push keeps track of the WebSocket clients subscribed to rate updates
+// and pushes updates to them through the API Gateway Management API.
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// ConnectionsKey is the Redis set of the IDs of the connected WebSocket
+// clients
+func ConnectionsKey() string {
+	return ratestore.MetaKey("wsConnections")
+}
+
+// AddConnection records a newly connected WebSocket client.
+func AddConnection(redisCli *redis.Client, connectionID string) error {
+	return redisCli.SAdd(ConnectionsKey(), connectionID).Err()
+}
+
+// RemoveConnection forgets a WebSocket client which has disconnected.
+func RemoveConnection(redisCli *redis.Client, connectionID string) error {
+	return redisCli.SRem(ConnectionsKey(), connectionID).Err()
+}
+
+// Endpoint returns the API Gateway Management API endpoint of the WebSocket
+// API, https://{api-id}.execute-api.{region}.amazonaws.com/{stage}, from the
+// WEBSOCKET_ENDPOINT env var. It's empty if pushing is disabled.
+func Endpoint() string {
+	return strings.TrimRight(os.Getenv("WEBSOCKET_ENDPOINT"), "/")
+}
+
+// broadcastConcurrency is how many clients Broadcast sends to at once
+const broadcastConcurrency = 10
+
+// postTimeout is how long sending to a single client may take, so a slow
+// client can't hold up a broadcast
+const postTimeout = 2 * time.Second
+
+// pushClient is the HTTP client PostToConnection requests are made with
+var pushClient = &http.Client{Timeout: postTimeout}
+
+// Broadcast sends payload to every connected WebSocket client through the
+// management API at endpoint, up to broadcastConcurrency clients at once, and
+// forgets clients which have gone away. It returns the number of clients the
+// payload was sent to.
+func Broadcast(ctx context.Context, redisCli *redis.Client, endpoint string, payload []byte) (int, error) {
+	ids, err := redisCli.SMembers(ConnectionsKey()).Result()
+	if err != nil {
+		return 0, err
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return 0, err
+	}
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return 0, err
+	}
+	signer := v4.NewSigner()
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		sent int
+		gone []interface{}
+	)
+	sem := make(chan struct{}, broadcastConcurrency)
+	for _, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := postToConnection(ctx, signer, creds, cfg.Region, endpoint, id, payload)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == errGone:
+				gone = append(gone, id)
+			case err != nil:
+				slog.Warn("unable to push to websocket client", "connectionId", id, "error", err)
+			default:
+				sent++
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	if len(gone) > 0 {
+		if err := redisCli.SRem(ConnectionsKey(), gone...).Err(); err != nil {
+			slog.Warn("unable to forget websocket clients", "error", err)
+		}
+	}
+	return sent, nil
+}
+
+// errGone is returned by postToConnection when the client has disconnected
+var errGone = fmt.Errorf("connection gone")
+
+// postToConnection sends payload to a single WebSocket client with a
+// PostToConnection request signed for region, giving up after postTimeout.
+func postToConnection(ctx context.Context, signer *v4.Signer, creds aws.Credentials, region, endpoint, connectionID string, payload []byte) error {
+	u := endpoint + "/@connections/" + url.PathEscape(connectionID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	payloadHash := sha256.Sum256(payload)
+	if err := signer.SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "execute-api", region, time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return errGone
+	case resp.StatusCode >= 300:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("PostToConnection status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// ratesMessage is the message sent to WebSocket clients with the current rates
+type ratesMessage struct {
+	Type  string                  `json:"type"`
+	Rates []ratestore.DashUSDRate `json:"rates"`
+}
+
+// RatesMessage returns the message sending the given rates to WebSocket
+// clients.
+func RatesMessage(rates []ratestore.DashUSDRate) ([]byte, error) {
+	if rates == nil {
+		rates = []ratestore.DashUSDRate{}
+	}
+	return json.Marshal(ratesMessage{Type: "rates", Rates: rates})
+}
@@ -0,0 +1,137 @@
+package push
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+// setup returns a Redis client backed by miniredis, with the given clients
+// connected, and sets the AWS credentials Broadcast signs requests with.
+func setup(t *testing.T, ids ...string) *redis.Client {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	mr := miniredis.RunT(t)
+	redisCli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { redisCli.Close() })
+	for _, id := range ids {
+		if err := AddConnection(redisCli, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return redisCli
+}
+
+func TestBroadcast(t *testing.T) {
+	redisCli := setup(t, "ok1", "ok2", "gone", "broken")
+
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			http.Error(w, "request not signed", http.StatusForbidden)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/@connections/")
+		switch id {
+		case "gone":
+			w.WriteHeader(http.StatusGone)
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			mu.Lock()
+			got = append(got, id)
+			mu.Unlock()
+		}
+	}))
+	defer srv.Close()
+
+	sent, err := Broadcast(context.Background(), redisCli, srv.URL, []byte(`{"type":"rates"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 || len(got) != 2 {
+		t.Errorf("sent = %d to %v, want 2", sent, got)
+	}
+	ids, err := redisCli.SMembers(ConnectionsKey()).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Errorf("connections = %v, want gone client forgotten", ids)
+	}
+}
+
+func TestBroadcastConcurrency(t *testing.T) {
+	ids := make([]string, 3*broadcastConcurrency)
+	for i := range ids {
+		ids[i] = strings.Repeat("c", i+1)
+	}
+	redisCli := setup(t, ids...)
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	sent, err := Broadcast(context.Background(), redisCli, srv.URL, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != len(ids) {
+		t.Errorf("sent = %d, want %d", sent, len(ids))
+	}
+	if maxInFlight <= 1 || maxInFlight > broadcastConcurrency {
+		t.Errorf("max concurrent posts = %d, want 2-%d", maxInFlight, broadcastConcurrency)
+	}
+}
+
+func TestBroadcastSlowClient(t *testing.T) {
+	redisCli := setup(t, "slow", "fast")
+
+	saved := pushClient
+	pushClient = &http.Client{Timeout: 50 * time.Millisecond}
+	defer func() { pushClient = saved }()
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/slow") {
+			<-release
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	start := time.Now()
+	sent, err := Broadcast(context.Background(), redisCli, srv.URL, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 {
+		t.Errorf("sent = %d, want 1", sent)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Broadcast took %v, want slow client abandoned", elapsed)
+	}
+}
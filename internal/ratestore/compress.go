@@ -0,0 +1,64 @@
+package ratestore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipMagic are the first two bytes of every gzip stream. Plain JSON values
+// always start with '{', so they double as the marker telling compressed and
+// uncompressed stored values apart.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maxDecompressedSize bounds how large a stored value may grow when it's
+// decompressed, so a foreign or poisoned value in a shared Redis can't exhaust
+// memory. Rates are well under a kilobyte.
+const maxDecompressedSize = 1 << 20
+
+// compressEnabled reports whether values should be gzipped before they're
+// stored, which is set with the REDIS_COMPRESS env var
+func compressEnabled() bool {
+	return EnvBool("REDIS_COMPRESS")
+}
+
+// compress gzips data
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress gunzips data if it's compressed, and otherwise returns it as-is,
+// so values stored before compression was enabled can still be read.
+func decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	// read one byte past the limit, to tell a value which is too big from one
+	// which is exactly the limit
+	out, err := io.ReadAll(io.LimitReader(zr, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressedSize {
+		return nil, fmt.Errorf("decompressed value exceeds %d bytes", maxDecompressedSize)
+	}
+	return out, nil
+}
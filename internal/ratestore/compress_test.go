@@ -0,0 +1,143 @@
+package ratestore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// benchRate is a fully populated rate, about the largest one which is stored
+func benchRate() *DashUSDRate {
+	vol := 123456.78
+	change := -1.25
+	return &DashUSDRate{
+		Name:      "Coinbase Pro",
+		Slug:      "coinbasepro",
+		RateUSD:   75.12,
+		VolumeUSD: &vol,
+		FetchedAt: time.Date(2020, 2, 20, 12, 0, 0, 0, time.UTC),
+		Pair:      "DASH/BTC",
+		RawPrice:  0.0075,
+		RawQuote:  "BTC",
+		Change24h: &change,
+		Prices:    map[string]float64{"USD": 75.12, "EUR": 67.6, "GBP": 60.1, "JPY": 8263.2},
+	}
+}
+
+func BenchmarkMarshalBinary(b *testing.B) {
+	for _, bc := range []struct{ name, compress string }{{"plain", "false"}, {"compressed", "true"}} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.Setenv("REDIS_COMPRESS", bc.compress)
+			rate := benchRate()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := rate.MarshalBinary(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	for _, bc := range []struct{ name, compress string }{{"plain", "false"}, {"compressed", "true"}} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.Setenv("REDIS_COMPRESS", bc.compress)
+			data, err := benchRate().MarshalBinary()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var rate DashUSDRate
+				if err := rate.UnmarshalBinary(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// gzipped returns data compressed, failing the test if it can't be
+func gzipped(tb testing.TB, data []byte) []byte {
+	tb.Helper()
+	out, err := compress(data)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return out
+}
+
+// fuzzSeeds are stored values which are realistic, or which a foreign or
+// poisoned value in a shared Redis might hold
+func fuzzSeeds(tb testing.TB) [][]byte {
+	rate := []byte(`{"exchange":"Kraken","slug":"kraken","price":75.12,"volume":1500,"fetchedAt":"2020-02-20T12:00:00Z","pair":"DASH/USD"}`)
+	gz := gzipped(tb, rate)
+	return [][]byte{
+		rate,
+		gz,
+		[]byte(`{"exchange":"Kraken","price":75}`),
+		nil,
+		[]byte("{"),
+		[]byte("null"),
+		[]byte("not json"),
+		[]byte(`{"price":"75"}`),
+		gzipMagic,
+		gz[:len(gz)/2],
+		gzipped(tb, []byte("not json")),
+		// a gzip bomb, decompressing past the limit
+		gzipped(tb, make([]byte, maxDecompressedSize+1)),
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	out, err := decompress(gzipped(t, bytes.Repeat([]byte{'a'}, maxDecompressedSize)))
+	if err != nil || len(out) != maxDecompressedSize {
+		t.Errorf("decompressing a value at the limit = %d bytes, %v", len(out), err)
+	}
+	if _, err := decompress(gzipped(t, make([]byte, maxDecompressedSize+1))); err == nil {
+		t.Error("decompressed a value past the limit")
+	}
+}
+
+func FuzzDecompress(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out, err := decompress(data)
+		if err != nil {
+			return
+		}
+		if len(out) > maxDecompressedSize {
+			t.Errorf("decompressed %d bytes, past the %d byte limit", len(out), maxDecompressedSize)
+		}
+		if !bytes.HasPrefix(data, gzipMagic) && !bytes.Equal(out, data) {
+			t.Error("uncompressed value changed by decompress")
+		}
+	})
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var rate DashUSDRate
+		if err := rate.UnmarshalBinary(data); err != nil {
+			return
+		}
+		// whatever was read back survives storing it again
+		out, err := rate.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again DashUSDRate
+		if err := again.UnmarshalBinary(out); err != nil {
+			t.Errorf("reading back %q: %v", out, err)
+		}
+	})
+}
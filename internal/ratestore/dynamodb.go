@@ -0,0 +1,178 @@
+package ratestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/projects/sls-dash-rate-service/internal/exchanges"
+)
+
+// DynamoStore is a RateStore keeping rates in a DynamoDB table, for
+// deployments where running Redis isn't worth it. The table's partition key is
+// the string attribute "exchange", the exchange's slug, and each item holds
+// the rate as JSON in "rate" and when it expires, in Unix seconds, in
+// "expiresAt", which should be the table's TTL attribute.
+type DynamoStore struct {
+	Table  string
+	Client *dynamodb.Client
+}
+
+// dynamoTimeout is how long a single DynamoDB API call may take, well within
+// the Lambda timeout
+const dynamoTimeout = 3 * time.Second
+
+// NewDynamoStore returns a DynamoStore for the table named by the RATE_TABLE
+// env var, with the Lambda function's region and credentials. DYNAMODB_ENDPOINT
+// overrides the endpoint, e.g. for DynamoDB Local.
+func NewDynamoStore() (*DynamoStore, error) {
+	if err := EnvCheck([]string{"RATE_TABLE"}); err != nil {
+		return nil, err
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(),
+		config.WithHTTPClient(awshttp.NewBuildableClient().WithTimeout(dynamoTimeout)))
+	if err != nil {
+		return nil, err
+	}
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return &DynamoStore{
+		Table:  os.Getenv("RATE_TABLE"),
+		Client: client,
+	}, nil
+}
+
+// dynamoBatchSize is the most items a single BatchWriteItem call may write
+const dynamoBatchSize = 25
+
+// PutAll is part of the RateStore interface. Rates are written with
+// BatchWriteItem, up to 25 per call. The client retries calls which fail or
+// are throttled, but items DynamoDB still leaves unprocessed are reported as
+// errors, to be written by the next fetch.
+func (s *DynamoStore) PutAll(ctx context.Context, rates []DashUSDRate, ttl time.Duration) map[string]error {
+	errs := make(map[string]error)
+	expiresAt := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+
+	// items are matched back to their rate by slug
+	names := make(map[string]string, len(rates))
+	var requests []types.WriteRequest
+	for _, rate := range rates {
+		data, err := json.Marshal(rate)
+		if err != nil {
+			errs[rate.Name] = err
+			continue
+		}
+		slug := exchanges.Slug(rate.Name)
+		names[slug] = rate.Name
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{
+			Item: map[string]types.AttributeValue{
+				"exchange":  &types.AttributeValueMemberS{Value: slug},
+				"rate":      &types.AttributeValueMemberS{Value: string(data)},
+				"expiresAt": &types.AttributeValueMemberN{Value: expiresAt},
+			},
+		}})
+	}
+
+	for start := 0; start < len(requests); start += dynamoBatchSize {
+		end := start + dynamoBatchSize
+		if end > len(requests) {
+			end = len(requests)
+		}
+		failed := requests[start:end]
+		out, err := s.Client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{s.Table: failed},
+		})
+		if err == nil {
+			failed = out.UnprocessedItems[s.Table]
+			err = fmt.Errorf("dynamodb left %d items unprocessed", len(failed))
+		}
+		for _, req := range failed {
+			errs[names[stringAttr(req.PutRequest.Item, "exchange")]] = err
+		}
+	}
+	return errs
+}
+
+// GetAll is part of the RateStore interface. It scans the whole table, which
+// only ever holds one item per exchange.
+func (s *DynamoStore) GetAll(ctx context.Context) ([]DashUSDRate, error) {
+	var rates []DashUSDRate
+	pages := dynamodb.NewScanPaginator(s.Client, &dynamodb.ScanInput{TableName: aws.String(s.Table)})
+	for pages.HasMorePages() {
+		out, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range out.Items {
+			if rate, ok := itemRate(item); ok {
+				rates = append(rates, rate)
+			}
+		}
+	}
+
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i].Name < rates[j].Name
+	})
+	return rates, nil
+}
+
+// Get is part of the RateStore interface.
+func (s *DynamoStore) Get(ctx context.Context, name string) (DashUSDRate, error) {
+	out, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Table),
+		Key: map[string]types.AttributeValue{
+			"exchange": &types.AttributeValueMemberS{Value: exchanges.Slug(name)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return DashUSDRate{}, err
+	}
+	rate, ok := itemRate(out.Item)
+	if !ok {
+		return DashUSDRate{}, ErrRateNotFound
+	}
+	return rate, nil
+}
+
+// itemRate returns the rate held in item, and false if there isn't one, it has
+// expired, or it's corrupt, which is logged. DynamoDB deletes expired items
+// lazily, so they're filtered out here.
+func itemRate(item map[string]types.AttributeValue) (DashUSDRate, bool) {
+	var rate DashUSDRate
+	if item == nil {
+		return rate, false
+	}
+	if expiresAt, ok := item["expiresAt"].(*types.AttributeValueMemberN); ok {
+		if secs, err := strconv.ParseInt(expiresAt.Value, 10, 64); err == nil && secs <= time.Now().Unix() {
+			return rate, false
+		}
+	}
+	if err := rate.UnmarshalBinary([]byte(stringAttr(item, "rate"))); err != nil {
+		slog.Warn("skipping invalid rate", "exchange", stringAttr(item, "exchange"), "error", err)
+		return rate, false
+	}
+	return rate, true
+}
+
+// stringAttr returns the string attribute of item with the given name, or ""
+// if there isn't one.
+func stringAttr(item map[string]types.AttributeValue, name string) string {
+	if attr, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return attr.Value
+	}
+	return ""
+}
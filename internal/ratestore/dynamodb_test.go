@@ -0,0 +1,237 @@
+package ratestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// dynamoItem is a DynamoDB item in the JSON API, keyed by attribute name, with
+// only the string and number attribute types DynamoStore writes
+type dynamoItem map[string]struct {
+	S string `json:"S,omitempty"`
+	N string `json:"N,omitempty"`
+}
+
+// dynamoWriteRequest is a single put in a BatchWriteItem call
+type dynamoWriteRequest struct {
+	PutRequest struct {
+		Item dynamoItem `json:"Item"`
+	} `json:"PutRequest"`
+}
+
+// fakeDynamo is an in-memory stand-in for the few DynamoDB API calls
+// DynamoStore makes. The first unprocessed items of each BatchWriteItem call
+// are left unprocessed, as DynamoDB does when it's throttling.
+type fakeDynamo struct {
+	sync.Mutex
+	items       map[string]dynamoItem
+	batchSizes  []int
+	unprocessed int
+	status      int
+}
+
+// newFakeDynamo returns a fake DynamoDB API and a DynamoStore whose client,
+// signing with static credentials and not retrying, calls it.
+func newFakeDynamo(t *testing.T) (*fakeDynamo, *DynamoStore) {
+	t.Helper()
+	fake := &fakeDynamo{items: make(map[string]dynamoItem)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	client := dynamodb.New(dynamodb.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		Credentials:  credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""),
+		Retryer:      aws.NopRetryer{},
+	})
+	return fake, &DynamoStore{Table: "rates", Client: client}
+}
+
+func (f *fakeDynamo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "request not signed", http.StatusForbidden)
+		return
+	}
+	if f.status != 0 {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(f.status)
+		fmt.Fprint(w, `{"__type":"InternalServerError"}`)
+		return
+	}
+
+	var out interface{}
+	switch target := r.Header.Get("X-Amz-Target"); target {
+	case "DynamoDB_20120810.BatchWriteItem":
+		var in struct {
+			RequestItems map[string][]dynamoWriteRequest
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests := in.RequestItems["rates"]
+		f.batchSizes = append(f.batchSizes, len(requests))
+		n := f.unprocessed
+		if n > len(requests) {
+			n = len(requests)
+		}
+		for _, req := range requests[n:] {
+			f.items[req.PutRequest.Item["exchange"].S] = req.PutRequest.Item
+		}
+		out = map[string]interface{}{
+			"UnprocessedItems": map[string][]dynamoWriteRequest{"rates": requests[:n]},
+		}
+	case "DynamoDB_20120810.Scan":
+		var items []dynamoItem
+		for _, item := range f.items {
+			items = append(items, item)
+		}
+		out = map[string]interface{}{"Items": items}
+	case "DynamoDB_20120810.GetItem":
+		var in struct {
+			Key dynamoItem
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if item, ok := f.items[in.Key["exchange"].S]; ok {
+			out = map[string]interface{}{"Item": item}
+		} else {
+			out = map[string]interface{}{}
+		}
+	default:
+		http.Error(w, "unknown target "+target, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(out)
+}
+
+// testRates returns n rates for made-up exchanges
+func testRates(n int) []DashUSDRate {
+	rates := make([]DashUSDRate, n)
+	for i := range rates {
+		rates[i] = DashUSDRate{
+			Name:      fmt.Sprintf("Exchange%02d", i),
+			RateUSD:   100 + float64(i),
+			FetchedAt: time.Date(2020, 2, 20, 12, 0, 0, 0, time.UTC),
+		}
+	}
+	return rates
+}
+
+func TestDynamoStorePutAllBatches(t *testing.T) {
+	fake, store := newFakeDynamo(t)
+
+	rates := testRates(30)
+	if errs := store.PutAll(context.Background(), rates, time.Minute); len(errs) != 0 {
+		t.Fatalf("PutAll errors: %v", errs)
+	}
+	if want := []int{25, 5}; fmt.Sprint(fake.batchSizes) != fmt.Sprint(want) {
+		t.Errorf("batch sizes = %v, want %v", fake.batchSizes, want)
+	}
+
+	got, err := store.GetAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(rates) {
+		t.Fatalf("GetAll returned %d rates, want %d", len(got), len(rates))
+	}
+	for i := range got {
+		if got[i].Name != rates[i].Name || got[i].RateUSD != rates[i].RateUSD {
+			t.Errorf("rate %d = %s %v, want %s %v", i, got[i].Name, got[i].RateUSD, rates[i].Name, rates[i].RateUSD)
+		}
+	}
+}
+
+func TestDynamoStorePutAllUnprocessed(t *testing.T) {
+	fake, store := newFakeDynamo(t)
+	fake.unprocessed = 2
+
+	rates := testRates(4)
+	errs := store.PutAll(context.Background(), rates, time.Minute)
+	if len(errs) != 2 {
+		t.Fatalf("PutAll errors = %v, want 2", errs)
+	}
+	for _, rate := range rates[:2] {
+		if errs[rate.Name] == nil {
+			t.Errorf("no error for unprocessed %s", rate.Name)
+		}
+	}
+	if len(fake.items) != 2 {
+		t.Errorf("stored %d items, want 2", len(fake.items))
+	}
+}
+
+func TestDynamoStoreGet(t *testing.T) {
+	_, store := newFakeDynamo(t)
+	ctx := context.Background()
+
+	if errs := store.PutAll(ctx, testRates(2), time.Minute); len(errs) != 0 {
+		t.Fatalf("PutAll errors: %v", errs)
+	}
+	rate, err := store.Get(ctx, "Exchange01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate.RateUSD != 101 {
+		t.Errorf("RateUSD = %v, want 101", rate.RateUSD)
+	}
+	if _, err := store.Get(ctx, "Exchange99"); !errors.Is(err, ErrRateNotFound) {
+		t.Errorf("Get unknown exchange err = %v, want ErrRateNotFound", err)
+	}
+}
+
+func TestDynamoStoreSkipsExpired(t *testing.T) {
+	_, store := newFakeDynamo(t)
+	ctx := context.Background()
+
+	if errs := store.PutAll(ctx, testRates(1), -time.Minute); len(errs) != 0 {
+		t.Fatalf("PutAll errors: %v", errs)
+	}
+	rates, err := store.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 0 {
+		t.Errorf("GetAll returned expired rates: %v", rates)
+	}
+}
+
+func TestDynamoStoreCallError(t *testing.T) {
+	fake, store := newFakeDynamo(t)
+	fake.status = http.StatusInternalServerError
+
+	_, err := store.GetAll(context.Background())
+	var respErr *awshttp.ResponseError
+	if !errors.As(err, &respErr) || respErr.HTTPStatusCode() != http.StatusInternalServerError {
+		t.Errorf("GetAll err = %v, want status 500", err)
+	}
+}
+
+func TestDynamoStoreCallCancelled(t *testing.T) {
+	_, store := newFakeDynamo(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := store.GetAll(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetAll err = %v, want context.Canceled", err)
+	}
+}
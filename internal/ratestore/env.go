@@ -0,0 +1,71 @@
+package ratestore
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EnvCheck is called upon startup to ensure the required environment variables
+// are set. The returned error names every one which isn't.
+func EnvCheck(reqd []string) error {
+	// ensure config vars set
+	var missing []string
+	for _, env := range reqd {
+		val, ok := os.LookupEnv(env)
+		if !ok || (len(val) == 0) {
+			missing = append(missing, env)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required env vars not set: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// EnvInt returns the integer value of the named environment variable, or def if
+// the variable is unset or not a valid integer.
+func EnvInt(name string, def int) int {
+	val, ok := os.LookupEnv(name)
+	if !ok || len(val) == 0 {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		slog.Warn("invalid env var, using default", "name", name, "value", val, "default", def)
+		return def
+	}
+	return n
+}
+
+// EnvFloat returns the float value of the named environment variable, or def
+// if the variable is unset or not a valid number.
+func EnvFloat(name string, def float64) float64 {
+	val, ok := os.LookupEnv(name)
+	if !ok || len(val) == 0 {
+		return def
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		slog.Warn("invalid env var, using default", "name", name, "value", val, "default", def)
+		return def
+	}
+	return f
+}
+
+// EnvBool reports whether the named environment variable is set to a true
+// value such as "1" or "true". Unset and invalid values are false.
+func EnvBool(name string) bool {
+	val, ok := os.LookupEnv(name)
+	if !ok || len(val) == 0 {
+		return false
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		slog.Warn("invalid env var, using false", "name", name, "value", val)
+		return false
+	}
+	return b
+}
@@ -0,0 +1,37 @@
+package ratestore
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/projects/sls-dash-rate-service/internal/exchanges"
+)
+
+// MaxOutcomes is the number of recent fetch outcomes kept for each exchange
+const MaxOutcomes = 50
+
+// FetchOutcome is the result of one attempt to fetch an exchange's rate
+type FetchOutcome struct {
+	At    time.Time `json:"at"`
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+
+	// FetchMs is how long the fetch took in milliseconds, including retries
+	FetchMs int64 `json:"fetchMs"`
+}
+
+// MarshalBinary is part of the encoding.BinaryMarshaler interface
+func (o *FetchOutcome) MarshalBinary() ([]byte, error) {
+	return json.Marshal(o)
+}
+
+// UnmarshalBinary is part of the encoding.BinaryUnmarshaler interface
+func (o *FetchOutcome) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, o)
+}
+
+// OutcomesKey returns the reserved Redis key for the list of recent fetch
+// outcomes of the given exchange, newest first.
+func OutcomesKey(displayName string) string {
+	return MetaKey("outcomes:" + exchanges.Slug(displayName))
+}
@@ -0,0 +1,202 @@
+// Package ratestore holds the Dash exchange rate type and the helpers for
+// storing rates in, and reading them back from, Redis which are shared by the
+// fetch and serve functions.
+package ratestore
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/exchanges"
+)
+
+// defaultKeyPrefix is the Redis key prefix used when REDIS_KEY_PREFIX is unset
+const defaultKeyPrefix = "dashrate:"
+
+// metaKeyPrefix follows the key prefix on reserved keys which don't hold
+// exchange rates
+const metaKeyPrefix = "_meta:"
+
+// HistoryWindow is how far back the price history for each exchange is kept
+const HistoryWindow = 24 * time.Hour
+
+// DashUSDRate is an entry for output to the exchange rate API
+type DashUSDRate struct {
+	Name string `json:"exchange"`
+
+	// Slug is the exchange's stable identifier, see exchanges.Canonical,
+	// while Name is its display name
+	Slug string `json:"slug,omitempty"`
+
+	RateUSD   float64   `json:"price"`
+	VolumeUSD *float64  `json:"volume,omitempty"`
+	FetchedAt time.Time `json:"fetchedAt"`
+
+	// Pair is the trading pair the price was fetched in, e.g. "DASH/BTC", which
+	// shows whether it was converted to USD. It's empty for rates stored before
+	// it was added.
+	Pair string `json:"pair,omitempty"`
+
+	// RawPrice and RawQuote are the price as reported by the exchange and the
+	// currency it's quoted in, before conversion to USD. They're only set if
+	// INCLUDE_RAW is enabled in fetch.
+	RawPrice float64 `json:"rawPrice,omitempty"`
+	RawQuote string  `json:"rawQuote,omitempty"`
+
+	// Change24h is the percent change in price over the history window. It
+	// is nil when there's no earlier rate to compare against.
+	Change24h *float64 `json:"change24h,omitempty"`
+
+	// Prices holds the price in each supported fiat currency, including USD,
+	// converted at fetch time. It's nil for rates stored before it was added,
+	// or if FX rates couldn't be fetched.
+	Prices map[string]float64 `json:"prices,omitempty"`
+
+	// FetchedAtAdjusted is set when the exchange reported a fetch time in the
+	// future, and FetchedAt was replaced with the time it was converted.
+	FetchedAtAdjusted bool `json:"fetchedAtAdjusted,omitempty"`
+}
+
+// MarshalBinary is part of the encoding.BinaryMarshaler interface. The JSON
+// is gzipped if REDIS_COMPRESS is set.
+func (rate *DashUSDRate) MarshalBinary() ([]byte, error) {
+	data, err := json.Marshal(rate)
+	if err != nil || !compressEnabled() {
+		return data, err
+	}
+	return compress(data)
+}
+
+// UnmarshalBinary is part of the encoding.BinaryUnmarshaler interface. It
+// accepts both gzipped and plain JSON, and fills in the slug of rates stored
+// before it was added.
+func (rate *DashUSDRate) UnmarshalBinary(data []byte) error {
+	data, err := decompress(data)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, rate); err != nil {
+		return err
+	}
+	if rate.Slug == "" {
+		rate.Slug = exchanges.Slug(rate.Name)
+	}
+	return nil
+}
+
+// GetRates gets all exchange rates from Redis, sorted by exchange name
+func GetRates(redisCli *redis.Client) ([]DashUSDRate, error) {
+	var emptyRates []DashUSDRate
+
+	// Collect keys via SCAN rather than KEYS, which blocks Redis
+	var exchanges []string
+	seen := make(map[string]bool)
+	var cursor uint64
+	for {
+		var keys []string
+		var err error
+		keys, cursor, err = redisCli.Scan(cursor, KeyPrefix()+"*", 100).Result()
+		if err != nil {
+			return emptyRates, err
+		}
+		for _, key := range keys {
+			// SCAN can return a key more than once, and reserved keys
+			// aren't exchange rates
+			if !seen[key] && !IsMetaKey(key) {
+				seen[key] = true
+				exchanges = append(exchanges, key)
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(exchanges) == 0 {
+		return emptyRates, nil
+	}
+
+	// Get all rates from Redis in a single round-trip
+	vals, err := redisCli.MGet(exchanges...).Result()
+	if err != nil {
+		return emptyRates, err
+	}
+
+	var ratesUSD []DashUSDRate
+	for i, val := range vals {
+		// key may have expired between SCAN and MGET
+		str, ok := val.(string)
+		if !ok {
+			continue
+		}
+		var rate DashUSDRate
+		if err := rate.UnmarshalBinary([]byte(str)); err != nil {
+			slog.Warn("skipping invalid rate", "key", exchanges[i], "error", err)
+			continue
+		}
+		ratesUSD = append(ratesUSD, rate)
+	}
+
+	// SCAN order is effectively random, so sort for a deterministic result
+	sort.SliceStable(ratesUSD, func(i, j int) bool {
+		return ratesUSD[i].Name < ratesUSD[j].Name
+	})
+	return ratesUSD, nil
+}
+
+// GetRate gets the rate for a single exchange, given its display name, with a
+// single GET. It returns nil if the exchange has no rate cached, or the cached
+// value is corrupt, which is logged.
+func GetRate(redisCli *redis.Client, displayName string) (*DashUSDRate, error) {
+	data, err := redisCli.Get(RateKey(displayName)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rate DashUSDRate
+	if err := rate.UnmarshalBinary(data); err != nil {
+		slog.Warn("skipping invalid rate", "key", RateKey(displayName), "error", err)
+		return nil, nil
+	}
+	return &rate, nil
+}
+
+// RateKey returns the Redis key under which the rate for the given exchange is
+// stored, named by its slug so it doesn't change with its display name.
+func RateKey(displayName string) string {
+	return KeyPrefix() + exchanges.Slug(displayName)
+}
+
+// MetaKey returns the reserved Redis key for the given non-rate value, such as
+// FX rates.
+func MetaKey(name string) string {
+	return KeyPrefix() + metaKeyPrefix + name
+}
+
+// HistoryKey returns the reserved Redis key for the sorted set holding the
+// price history of the given exchange.
+func HistoryKey(displayName string) string {
+	return MetaKey("history:" + exchanges.Slug(displayName))
+}
+
+// IsMetaKey reports whether the given Redis key is a reserved key rather than
+// an exchange rate.
+func IsMetaKey(key string) bool {
+	return strings.HasPrefix(key, KeyPrefix()+metaKeyPrefix)
+}
+
+// KeyPrefix returns the prefix applied to all Redis keys, so that rates don't
+// collide with other data in a shared Redis instance.
+func KeyPrefix() string {
+	prefix, ok := os.LookupEnv("REDIS_KEY_PREFIX")
+	if !ok {
+		return defaultKeyPrefix
+	}
+	return prefix
+}
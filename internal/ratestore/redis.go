@@ -0,0 +1,162 @@
+package ratestore
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrRedisUnavailable is returned when the Redis instance can't be reached
+var ErrRedisUnavailable = errors.New("error: unable to ping redis")
+
+// sharedClient is the Redis client reused by every invocation a container
+// handles, see RedisClient
+var sharedClient struct {
+	sync.Mutex
+	url    string
+	client *redis.Client
+}
+
+// NewRedisClient creates a Redis client for redisURL and checks the connection
+// via PING. The caller owns the client and should close it when done; handlers
+// should use the shared client from RedisClient instead.
+func NewRedisClient(redisURL string) (*redis.Client, error) {
+	opts, err := redisOptions(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	redisCli := redis.NewClient(opts)
+	if err := pingRedis(redisCli); err != nil {
+		redisCli.Close()
+		return nil, err
+	}
+	return redisCli, nil
+}
+
+// RedisClient returns the Redis client for redisURL, checking the connection
+// via PING. The client is created on first use and kept for later invocations
+// in the same container, so its connection pool (see setPoolOptions) is reused
+// rather than a new one being opened, and leaked, for every invocation.
+// Callers mustn't close it. Should redisURL change, the old client is closed
+// and replaced.
+func RedisClient(redisURL string) (*redis.Client, error) {
+	sharedClient.Lock()
+	defer sharedClient.Unlock()
+
+	if sharedClient.client != nil && sharedClient.url != redisURL {
+		sharedClient.client.Close()
+		sharedClient.client = nil
+	}
+	if sharedClient.client == nil {
+		opts, err := redisOptions(redisURL)
+		if err != nil {
+			return nil, err
+		}
+		sharedClient.client = redis.NewClient(opts)
+		sharedClient.url = redisURL
+	}
+
+	// a failed PING leaves the client in place, as the pool reconnects once
+	// Redis is back
+	if err := pingRedis(sharedClient.client); err != nil {
+		return nil, err
+	}
+	return sharedClient.client, nil
+}
+
+// pingRedis ensures redisCli is connected to Redis. The address alone is
+// reported, as the URL may contain a password.
+func pingRedis(redisCli *redis.Client) error {
+	if _, err := redisCli.Ping().Result(); err != nil {
+		return fmt.Errorf("%w at '%s'", ErrRedisUnavailable, redisCli.Options().Addr)
+	}
+	return nil
+}
+
+// redisOptions returns the client options for the given Redis URL. A full
+// redis:// or rediss:// (TLS) URL may include a password and DB number, e.g.
+// rediss://:password@host:6379/1. For backward compatibility, anything which
+// doesn't parse as such is treated as a bare host:port address.
+//
+// Unless the URL gives a DB number, the DB is taken from the REDIS_DB env var,
+// defaulting to 0. An invalid REDIS_DB is an error.
+func redisOptions(redisURL string) (*redis.Options, error) {
+	db, err := redisDB()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err == nil {
+		if !urlHasDB(redisURL) {
+			opts.DB = db
+		}
+	} else {
+		opts = &redis.Options{
+			Addr:     redisURL,
+			Password: "", // no password set
+			DB:       db,
+		}
+	}
+	setPoolOptions(opts)
+	return opts, nil
+}
+
+// Lambda-friendly connection pool defaults. Each container handles one
+// invocation at a time and makes its Redis calls one after another, so a
+// small pool, shared by every invocation (see RedisClient), is plenty, and
+// idle connections are dropped quickly so frozen containers don't hold
+// connections open on the server.
+const (
+	defaultPoolSize       = 4
+	defaultMinIdleConns   = 0
+	defaultIdleTimeoutSec = 30
+	defaultDialTimeoutMS  = 2000
+	defaultReadTimeoutMS  = 1000
+	defaultWriteTimeoutMS = 1000
+	defaultPoolTimeoutMS  = 2000
+)
+
+// setPoolOptions sets the connection pool size and timeouts of opts from the
+// REDIS_POOL_SIZE, REDIS_MIN_IDLE_CONNS, REDIS_IDLE_TIMEOUT_SEC,
+// REDIS_DIAL_TIMEOUT_MS, REDIS_READ_TIMEOUT_MS, REDIS_WRITE_TIMEOUT_MS and
+// REDIS_POOL_TIMEOUT_MS env vars, using the defaults above for any which are
+// unset.
+func setPoolOptions(opts *redis.Options) {
+	opts.PoolSize = EnvInt("REDIS_POOL_SIZE", defaultPoolSize)
+	opts.MinIdleConns = EnvInt("REDIS_MIN_IDLE_CONNS", defaultMinIdleConns)
+	opts.IdleTimeout = time.Duration(EnvInt("REDIS_IDLE_TIMEOUT_SEC", defaultIdleTimeoutSec)) * time.Second
+	opts.DialTimeout = time.Duration(EnvInt("REDIS_DIAL_TIMEOUT_MS", defaultDialTimeoutMS)) * time.Millisecond
+	opts.ReadTimeout = time.Duration(EnvInt("REDIS_READ_TIMEOUT_MS", defaultReadTimeoutMS)) * time.Millisecond
+	opts.WriteTimeout = time.Duration(EnvInt("REDIS_WRITE_TIMEOUT_MS", defaultWriteTimeoutMS)) * time.Millisecond
+	opts.PoolTimeout = time.Duration(EnvInt("REDIS_POOL_TIMEOUT_MS", defaultPoolTimeoutMS)) * time.Millisecond
+}
+
+// redisDB returns the Redis DB number from the REDIS_DB env var, or 0 if it's
+// unset.
+func redisDB() (int, error) {
+	val, ok := os.LookupEnv("REDIS_DB")
+	if !ok || len(val) == 0 {
+		return 0, nil
+	}
+	db, err := strconv.Atoi(val)
+	if err != nil || db < 0 {
+		return 0, fmt.Errorf("invalid REDIS_DB '%s': must be a non-negative integer", val)
+	}
+	return db, nil
+}
+
+// urlHasDB reports whether the Redis URL names a DB number in its path.
+func urlHasDB(redisURL string) bool {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return false
+	}
+	return strings.Trim(u.Path, "/") != ""
+}
@@ -0,0 +1,104 @@
+package ratestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrRateNotFound is returned by RateStore.Get when the exchange has no rate
+// stored
+var ErrRateNotFound = errors.New("no rate stored")
+
+// RateStore is where the latest rate of each exchange is kept. Redis is the
+// default, and the only store with the price history, FX rates and the other
+// values kept alongside the rates.
+type RateStore interface {
+	// PutAll stores rates, replacing each exchange's previous rate, until ttl
+	// has passed. The rates are written in as few requests as the store
+	// allows. It returns the error for each rate which couldn't be stored,
+	// keyed by exchange name.
+	PutAll(ctx context.Context, rates []DashUSDRate, ttl time.Duration) map[string]error
+
+	// GetAll returns the stored rate of every exchange, sorted by exchange
+	// name.
+	GetAll(ctx context.Context) ([]DashUSDRate, error)
+
+	// Get returns the stored rate of the exchange with the given display
+	// name, or ErrRateNotFound.
+	Get(ctx context.Context, name string) (DashUSDRate, error)
+}
+
+// rate stores selectable with RATE_STORE
+const (
+	StoreRedis    = "redis"
+	StoreDynamoDB = "dynamodb"
+)
+
+// StoreKind returns the rate store selected with the RATE_STORE env var,
+// StoreRedis when it's unset.
+func StoreKind() (string, error) {
+	kind := strings.ToLower(os.Getenv("RATE_STORE"))
+	switch kind {
+	case "", StoreRedis:
+		return StoreRedis, nil
+	case StoreDynamoDB:
+		return StoreDynamoDB, nil
+	}
+	return "", fmt.Errorf("invalid RATE_STORE '%s': must be %s or %s", kind, StoreRedis, StoreDynamoDB)
+}
+
+// RedisStore is a RateStore keeping rates in Redis
+type RedisStore struct {
+	Client *redis.Client
+}
+
+// PutAll is part of the RateStore interface. Every rate is written in a
+// single MULTI/EXEC transaction, so readers never see a mix of this batch and
+// the last. Rates stored under their display name, as they were before slugs,
+// are deleted in the same transaction.
+func (s *RedisStore) PutAll(ctx context.Context, rates []DashUSDRate, ttl time.Duration) map[string]error {
+	pipe := s.Client.WithContext(ctx).TxPipeline()
+	cmds := make([]*redis.StatusCmd, len(rates))
+	for i := range rates {
+		cmds[i] = pipe.Set(RateKey(rates[i].Name), &rates[i], ttl)
+		if legacyKey := KeyPrefix() + rates[i].Name; legacyKey != RateKey(rates[i].Name) {
+			pipe.Del(legacyKey)
+		}
+	}
+	// errors are checked per command, so one failed write doesn't hide the
+	// outcome of the others. Redis still runs the rest of a transaction when
+	// one command in it fails, and if EXEC itself fails every command carries
+	// its error.
+	_, _ = pipe.Exec()
+
+	errs := make(map[string]error)
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			errs[rates[i].Name] = err
+		}
+	}
+	return errs
+}
+
+// GetAll is part of the RateStore interface.
+func (s *RedisStore) GetAll(ctx context.Context) ([]DashUSDRate, error) {
+	return GetRates(s.Client.WithContext(ctx))
+}
+
+// Get is part of the RateStore interface.
+func (s *RedisStore) Get(ctx context.Context, name string) (DashUSDRate, error) {
+	rate, err := GetRate(s.Client.WithContext(ctx), name)
+	if err != nil {
+		return DashUSDRate{}, err
+	}
+	if rate == nil {
+		return DashUSDRate{}, ErrRateNotFound
+	}
+	return *rate, nil
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// rateAggregate is a consensus price computed across all exchanges. Fields are
+// nil when there are no rates to aggregate.
+type rateAggregate struct {
+	Median *float64 `json:"median"`
+	VWAP   *float64 `json:"vwap"`
+
+	// TrimmedMean is the mean price excluding the highest and lowest,
+	// volume-weighted if every remaining exchange reported a volume. With
+	// three or fewer prices it's the median.
+	TrimmedMean *float64 `json:"trimmedMean"`
+
+	// VWAPFallback is set when fewer than two exchanges reported a volume, so
+	// VWAP is just the median
+	VWAPFallback bool `json:"vwapFallback"`
+
+	// TotalVolumeUSD is a naive sum of the volume reported by every exchange,
+	// in the response's base currency. Exchanges with no reported volume are
+	// left out, and volume on cross-listed pairs may be counted more than
+	// once, so it's only a rough measure of market activity.
+	TotalVolumeUSD *float64 `json:"totalVolumeUsd"`
+
+	// SpreadPct is the difference between the highest and lowest price as a
+	// percentage of the median, nil with fewer than two prices
+	SpreadPct *float64 `json:"spreadPct"`
+
+	// Low and High are the lowest and highest consensus prices, and
+	// LowExchange and HighExchange the exchanges which reported them. They're
+	// null and empty when there are no rates.
+	Low          *float64 `json:"low"`
+	High         *float64 `json:"high"`
+	LowExchange  string   `json:"lowExchange"`
+	HighExchange string   `json:"highExchange"`
+
+	// PrimaryPrice is the median price of the exchanges in PRIMARY_EXCHANGES,
+	// the headline figure. If none of them have a rate it's Median, and
+	// PrimaryFallback is set. It's nil when PRIMARY_EXCHANGES is unset.
+	PrimaryPrice    *float64 `json:"primaryPrice,omitempty"`
+	PrimaryFallback bool     `json:"primaryFallback,omitempty"`
+
+	// WeightedPrice is the mean consensus price weighted by each exchange's
+	// weight in EXCHANGE_WEIGHTS, 1 for those not listed. It's nil if every
+	// weight is zero.
+	WeightedPrice *float64 `json:"weightedPrice"`
+
+	// Outliers lists exchanges whose prices were left out of the consensus
+	Outliers []string `json:"outliers,omitempty"`
+}
+
+// aggregateRates computes the median and volume-weighted average price of the
+// given rates, after rejecting prices more than k median absolute deviations
+// from the median (k <= 0 disables this). Only rates with a positive reported
+// volume count towards the VWAP, and if there are fewer than two of them the
+// VWAP falls back to the median. The spread and the low and high are also
+// taken after rejecting outliers, as is the weighted price, so outliers have
+// no weight. The total volume is summed over all the given rates. The primary
+// price is taken over the rates of the primary exchanges, which are trusted,
+// so outliers aren't rejected from it.
+func aggregateRates(rates []ratestore.DashUSDRate, k float64, primary []string, weights map[string]float64) rateAggregate {
+	var agg rateAggregate
+	if len(rates) == 0 {
+		return agg
+	}
+	agg.TotalVolumeUSD = totalVolume(rates)
+	allRates := rates
+	rates, agg.Outliers = rejectOutliers(rates, k)
+
+	prices := make([]float64, len(rates))
+	for i, rate := range rates {
+		prices[i] = rate.RateUSD
+	}
+	median := medianOf(prices)
+	agg.Median = &median
+	agg.SpreadPct = spreadPct(prices, median)
+	agg.TrimmedMean = trimmedMean(rates, median)
+	agg.Low, agg.LowExchange, agg.High, agg.HighExchange = priceRange(rates)
+	agg.WeightedPrice = weightedPrice(rates, weights)
+	if len(primary) > 0 {
+		agg.PrimaryPrice, agg.PrimaryFallback = primaryPrice(allRates, primary, median)
+	}
+
+	var weighted, weightedVolume float64
+	var withVolume int
+	for _, rate := range rates {
+		if rate.VolumeUSD == nil || *rate.VolumeUSD <= 0 {
+			continue
+		}
+		weighted += rate.RateUSD * *rate.VolumeUSD
+		weightedVolume += *rate.VolumeUSD
+		withVolume++
+	}
+	// a VWAP of a single exchange would just be that exchange's price
+	if withVolume < 2 {
+		agg.VWAP = &median
+		agg.VWAPFallback = true
+		return agg
+	}
+	vwap := weighted / weightedVolume
+	agg.VWAP = &vwap
+	return agg
+}
+
+// totalVolume returns the sum of the reported volume of the given rates, or nil
+// if none of them report a volume.
+func totalVolume(rates []ratestore.DashUSDRate) *float64 {
+	var total float64
+	reported := false
+	for _, rate := range rates {
+		if rate.VolumeUSD == nil {
+			continue
+		}
+		total += *rate.VolumeUSD
+		reported = true
+	}
+	if !reported {
+		return nil
+	}
+	return &total
+}
+
+// trimmedMean returns the mean price of rates after dropping the highest and
+// lowest, weighted by volume if every remaining rate has a positive volume.
+// With three or fewer rates, which would leave at most one price, it returns
+// the given median instead.
+func trimmedMean(rates []ratestore.DashUSDRate, median float64) *float64 {
+	if len(rates) <= 3 {
+		return &median
+	}
+	sorted := make([]ratestore.DashUSDRate, len(rates))
+	copy(sorted, rates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].RateUSD < sorted[j].RateUSD
+	})
+	trimmed := sorted[1 : len(sorted)-1]
+
+	var sum, weighted, volume float64
+	weightable := true
+	for _, rate := range trimmed {
+		sum += rate.RateUSD
+		if rate.VolumeUSD == nil || *rate.VolumeUSD <= 0 {
+			weightable = false
+			continue
+		}
+		weighted += rate.RateUSD * *rate.VolumeUSD
+		volume += *rate.VolumeUSD
+	}
+	mean := sum / float64(len(trimmed))
+	if weightable {
+		mean = weighted / volume
+	}
+	return &mean
+}
+
+// primaryPrice returns the median price of the rates of the named exchanges,
+// given as display names (matched case-insensitively) or slugs, or if there
+// are none, the given median and true.
+func primaryPrice(rates []ratestore.DashUSDRate, primary []string, median float64) (*float64, bool) {
+	wanted := make(map[string]bool, len(primary))
+	for _, name := range primary {
+		wanted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	var prices []float64
+	for _, rate := range rates {
+		if wanted[strings.ToLower(rate.Name)] || wanted[rate.Slug] {
+			prices = append(prices, rate.RateUSD)
+		}
+	}
+	if len(prices) == 0 {
+		return &median, true
+	}
+	price := medianOf(prices)
+	return &price, false
+}
+
+// weightedPrice returns the mean price of rates weighted by weights, keyed by
+// lower-case display name or slug, with a weight of 1 for exchanges not in
+// it. Weights are normalized over the given rates, so with equal weights this
+// is the simple mean. It returns nil if every weight is zero.
+func weightedPrice(rates []ratestore.DashUSDRate, weights map[string]float64) *float64 {
+	var weighted, total float64
+	for _, rate := range rates {
+		weight := 1.0
+		if w, ok := weights[strings.ToLower(rate.Name)]; ok {
+			weight = w
+		} else if w, ok := weights[rate.Slug]; ok {
+			weight = w
+		}
+		weighted += rate.RateUSD * weight
+		total += weight
+	}
+	if total == 0 {
+		return nil
+	}
+	price := weighted / total
+	return &price
+}
+
+// exchangeWeights is the trust weight of each exchange, set once at startup
+// from EXCHANGE_WEIGHTS, see parseExchangeWeights
+var exchangeWeights map[string]float64
+
+// parseExchangeWeights returns the trust weight of each exchange from the
+// EXCHANGE_WEIGHTS env var, a JSON object of exchange display names or slugs
+// to non-negative numbers, e.g. {"Kraken": 2, "yobit": 0.5}. Keys are
+// lower-cased. It returns nil if the variable is unset or invalid, which is
+// logged, and negative weights are logged and ignored.
+func parseExchangeWeights() map[string]float64 {
+	val := os.Getenv("EXCHANGE_WEIGHTS")
+	if strings.TrimSpace(val) == "" {
+		return nil
+	}
+	var raw map[string]float64
+	if err := json.Unmarshal([]byte(val), &raw); err != nil {
+		slog.Warn("invalid EXCHANGE_WEIGHTS, ignoring", "error", err)
+		return nil
+	}
+	weights := make(map[string]float64, len(raw))
+	for name, weight := range raw {
+		if weight < 0 {
+			slog.Warn("negative weight in EXCHANGE_WEIGHTS, ignoring", "exchange", name, "weight", weight)
+			continue
+		}
+		weights[strings.ToLower(strings.TrimSpace(name))] = weight
+	}
+	return weights
+}
+
+// primaryExchanges returns the exchanges the headline price is taken from, from
+// the comma-separated PRIMARY_EXCHANGES env var of display names or slugs, or
+// nil if it's unset.
+func primaryExchanges() []string {
+	var names []string
+	for _, name := range strings.Split(os.Getenv("PRIMARY_EXCHANGES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// priceRange returns the lowest and highest price of a non-empty slice of
+// rates, and the exchanges which reported them. Ties go to the first rate.
+func priceRange(rates []ratestore.DashUSDRate) (low *float64, lowExch string, high *float64, highExch string) {
+	lo, hi := rates[0], rates[0]
+	for _, rate := range rates[1:] {
+		if rate.RateUSD < lo.RateUSD {
+			lo = rate
+		}
+		if rate.RateUSD > hi.RateUSD {
+			hi = rate
+		}
+	}
+	return &lo.RateUSD, lo.Name, &hi.RateUSD, hi.Name
+}
+
+// spreadPct returns the difference between the highest and lowest of the given
+// prices as a percentage of their median, or nil if there are fewer than two
+// prices.
+func spreadPct(prices []float64, median float64) *float64 {
+	if len(prices) < 2 || median == 0 {
+		return nil
+	}
+	lo, hi := prices[0], prices[0]
+	for _, price := range prices[1:] {
+		lo = math.Min(lo, price)
+		hi = math.Max(hi, price)
+	}
+	spread := (hi - lo) / median * 100
+	return &spread
+}
+
+// medianOf returns the median of a non-empty slice of values
+func medianOf(values []float64) float64 {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// rejectOutliers splits rates into those whose price is within k median
+// absolute deviations (MAD) of the median price, and the names of the
+// exchanges whose price isn't. Nothing is rejected if k <= 0, there are fewer
+// than three rates, or the MAD is zero.
+func rejectOutliers(rates []ratestore.DashUSDRate, k float64) ([]ratestore.DashUSDRate, []string) {
+	if k <= 0 || len(rates) < 3 {
+		return rates, nil
+	}
+
+	prices := make([]float64, len(rates))
+	for i, rate := range rates {
+		prices[i] = rate.RateUSD
+	}
+	median := medianOf(prices)
+
+	deviations := make([]float64, len(prices))
+	for i, price := range prices {
+		deviations[i] = math.Abs(price - median)
+	}
+	mad := medianOf(deviations)
+	if mad == 0 {
+		return rates, nil
+	}
+
+	var kept []ratestore.DashUSDRate
+	var outliers []string
+	for i, rate := range rates {
+		if deviations[i]/mad > k {
+			outliers = append(outliers, rate.Name)
+			continue
+		}
+		kept = append(kept, rate)
+	}
+	return kept, outliers
+}
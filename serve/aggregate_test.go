@@ -0,0 +1,238 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/projects/sls-dash-rate-service/internal/exchanges"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// testRate returns a rate for the named exchange at the given price, with a
+// volume if vol is positive
+func testRate(name string, price, vol float64) ratestore.DashUSDRate {
+	r := ratestore.DashUSDRate{Name: name, Slug: exchanges.Slug(name), RateUSD: price}
+	if vol > 0 {
+		r.VolumeUSD = &vol
+	}
+	return r
+}
+
+// approxEqual reports whether got is within a small tolerance of want
+func approxEqual(got, want float64) bool {
+	return math.Abs(got-want) < 1e-9
+}
+
+func TestWeightedPrice(t *testing.T) {
+	rates := []ratestore.DashUSDRate{
+		testRate("Kraken", 100, 0),
+		testRate("Coinbase Pro", 110, 0),
+		testRate("Yobit", 130, 0),
+	}
+	tests := []struct {
+		name    string
+		weights map[string]float64
+		want    *float64
+	}{
+		{"no weights is the simple mean", nil, ptr(340.0 / 3)},
+		{"equal weights is the simple mean", map[string]float64{"kraken": 2, "coinbase pro": 2, "yobit": 2}, ptr(340.0 / 3)},
+		{"unlisted exchanges weigh 1", map[string]float64{"yobit": 0}, ptr(105)},
+		{"name key", map[string]float64{"kraken": 3}, ptr((300.0 + 110 + 130) / 5)},
+		{"slug key", map[string]float64{"coinbasepro": 3}, ptr((100.0 + 330 + 130) / 5)},
+		{"all zero weights", map[string]float64{"kraken": 0, "coinbasepro": 0, "yobit": 0}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := weightedPrice(rates, tt.weights)
+			switch {
+			case tt.want == nil && got != nil:
+				t.Errorf("weightedPrice = %v, want nil", *got)
+			case tt.want != nil && got == nil:
+				t.Errorf("weightedPrice = nil, want %v", *tt.want)
+			case tt.want != nil && !approxEqual(*got, *tt.want):
+				t.Errorf("weightedPrice = %v, want %v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestPrimaryPrice(t *testing.T) {
+	rates := []ratestore.DashUSDRate{
+		testRate("Kraken", 100, 0),
+		testRate("Coinbase Pro", 110, 0),
+		testRate("Yobit", 130, 0),
+	}
+	tests := []struct {
+		name     string
+		primary  []string
+		want     float64
+		fallback bool
+	}{
+		{"name", []string{"Kraken"}, 100, false},
+		{"name in any case", []string{" coinbase pro "}, 110, false},
+		{"slug", []string{"coinbasepro"}, 110, false},
+		{"names and slugs", []string{"kraken", "coinbasepro", "Yobit"}, 110, false},
+		{"none with a rate", []string{"bitfinex"}, 105, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, fallback := primaryPrice(rates, tt.primary, 105)
+			if !approxEqual(*got, tt.want) || fallback != tt.fallback {
+				t.Errorf("primaryPrice = %v, %v, want %v, %v", *got, fallback, tt.want, tt.fallback)
+			}
+		})
+	}
+}
+
+func TestParseExchangeWeights(t *testing.T) {
+	tests := []struct {
+		env  string
+		want map[string]float64
+	}{
+		{"", nil},
+		{"not json", nil},
+		{`{"Kraken": 2, " yobit ": 0.5}`, map[string]float64{"kraken": 2, "yobit": 0.5}},
+		{`{"Kraken": -1, "Bitfinex": 0}`, map[string]float64{"bitfinex": 0}},
+	}
+	for _, tt := range tests {
+		t.Setenv("EXCHANGE_WEIGHTS", tt.env)
+		got := parseExchangeWeights()
+		if (got == nil) != (tt.want == nil) || len(got) != len(tt.want) {
+			t.Errorf("parseExchangeWeights(%q) = %v, want %v", tt.env, got, tt.want)
+			continue
+		}
+		for name, weight := range tt.want {
+			if w, ok := got[name]; !ok || w != weight {
+				t.Errorf("parseExchangeWeights(%q)[%q] = %v, want %v", tt.env, name, w, weight)
+			}
+		}
+	}
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
+
+// testRates returns rates at the given prices, for exchanges named A, B, ...
+func testRates(prices ...float64) []ratestore.DashUSDRate {
+	rates := make([]ratestore.DashUSDRate, len(prices))
+	for i, price := range prices {
+		rates[i] = testRate(string(rune('A'+i)), price, 0)
+	}
+	return rates
+}
+
+func TestTrimmedMean(t *testing.T) {
+	tests := []struct {
+		name   string
+		rates  []ratestore.DashUSDRate
+		median float64
+		want   float64
+	}{
+		{"none", nil, 0, 0},
+		{"one", testRates(100), 100, 100},
+		{"two", testRates(100, 110), 105, 105},
+		{"three is the median", testRates(100, 110, 200), 110, 110},
+		{"four drops highest and lowest", testRates(90, 100, 110, 500), 105, 105},
+		{"many unweighted", testRates(1, 100, 102, 104, 106, 1000), 103, 103},
+		{
+			"volume weighted",
+			[]ratestore.DashUSDRate{
+				testRate("A", 1, 5),
+				testRate("B", 100, 1),
+				testRate("C", 110, 3),
+				testRate("D", 1000, 5),
+			},
+			105, (100 + 110*3) / 4.0,
+		},
+		{
+			"unweighted if any volume is missing",
+			[]ratestore.DashUSDRate{
+				testRate("A", 1, 5),
+				testRate("B", 100, 0),
+				testRate("C", 110, 3),
+				testRate("D", 1000, 5),
+			},
+			105, 105,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := trimmedMean(tt.rates, tt.median)
+			if got == nil || !approxEqual(*got, tt.want) {
+				t.Errorf("trimmedMean = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectOutliers(t *testing.T) {
+	tests := []struct {
+		name     string
+		rates    []ratestore.DashUSDRate
+		k        float64
+		kept     int
+		outliers []string
+	}{
+		{"none", nil, 3, 0, nil},
+		{"one", testRates(100), 3, 1, nil},
+		{"two", testRates(100, 1000), 3, 2, nil},
+		{"three", testRates(100, 101, 1000), 3, 2, []string{"C"}},
+		{"many", testRates(100, 101, 99, 102, 98, 50, 1000), 3, 5, []string{"F", "G"}},
+		{"within k", testRates(100, 102, 98, 104, 96), 3, 5, nil},
+		{"disabled", testRates(100, 101, 1000), 0, 3, nil},
+		{"MAD zero", testRates(100, 100, 100, 1000), 3, 4, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, outliers := rejectOutliers(tt.rates, tt.k)
+			if len(kept) != tt.kept {
+				t.Errorf("kept %d rates, want %d", len(kept), tt.kept)
+			}
+			if len(outliers) != len(tt.outliers) {
+				t.Fatalf("outliers = %v, want %v", outliers, tt.outliers)
+			}
+			for i := range outliers {
+				if outliers[i] != tt.outliers[i] {
+					t.Errorf("outliers = %v, want %v", outliers, tt.outliers)
+				}
+			}
+		})
+	}
+}
+
+func TestAggregateRatesVWAPFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		rates    []ratestore.DashUSDRate
+		vwap     float64
+		fallback bool
+	}{
+		{
+			"no volumes",
+			testRates(100, 110, 120),
+			110, true,
+		},
+		{
+			"one volume",
+			[]ratestore.DashUSDRate{testRate("A", 100, 5), testRate("B", 110, 0), testRate("C", 120, 0)},
+			110, true,
+		},
+		{
+			"two volumes, others left out",
+			[]ratestore.DashUSDRate{testRate("A", 100, 3), testRate("B", 110, 0), testRate("C", 120, 1)},
+			105, false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agg := aggregateRates(tt.rates, 0, nil, nil)
+			if agg.VWAP == nil || !approxEqual(*agg.VWAP, tt.vwap) {
+				t.Errorf("VWAP = %v, want %v", agg.VWAP, tt.vwap)
+			}
+			if agg.VWAPFallback != tt.fallback {
+				t.Errorf("VWAPFallback = %v, want %v", agg.VWAPFallback, tt.fallback)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/subtle"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// apiKeyHeader is the request header carrying a client's API key
+const apiKeyHeader = "X-Api-Key"
+
+// serveAPIKeys returns the API keys allowed to call serve, from the
+// comma-separated SERVE_API_KEYS env var. It's empty when serve is open to
+// anyone.
+func serveAPIKeys() []string {
+	var keys []string
+	for _, key := range strings.Split(os.Getenv("SERVE_API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// authorized reports whether req may be served: either no API keys are
+// configured, or its X-Api-Key header matches one of them.
+func authorized(req events.APIGatewayProxyRequest) bool {
+	keys := serveAPIKeys()
+	if len(keys) == 0 {
+		return true
+	}
+	given := headerValue(req.Headers, apiKeyHeader)
+	if given == "" {
+		return false
+	}
+	for _, key := range keys {
+		// compare in constant time, so keys can't be guessed by timing
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// unauthorizedResponse returns a 401 for req.
+func unauthorizedResponse(req events.APIGatewayProxyRequest) Response {
+	return errorResponse(req, 401, "missing or invalid API key")
+}
@@ -1,13 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/exchanges"
+	"github.com/projects/sls-dash-rate-service/internal/logging"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -19,124 +32,926 @@ import (
 // https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
 type Response events.APIGatewayProxyResponse
 
+// defaultOutlierK is the number of median absolute deviations from the median
+// beyond which a price is treated as an outlier, when OUTLIER_MAD_K is unset
+const defaultOutlierK = 3.0
+
+// defaultFetchIntervalSec is how often the fetch function is scheduled to run
+// when FETCH_INTERVAL_SEC is unset, matching serverless.yml
+const defaultFetchIntervalSec = 1800
+
+// defaultRetryAfterSec is the Retry-After sent with a 503 for missing rates
+// when the next fetch time can't be worked out
+const defaultRetryAfterSec = 60
+
+// responseVersion is the version of the serve response schema, reported in
+// the response envelope. Bump it whenever a breaking change to the response
+// ships.
+const responseVersion = 2
+
+// prometheusContentType is the content type of the Prometheus text exposition
+// format
+const prometheusContentType = "text/plain; version=0.0.4"
+
 // Handler is our lambda handler invoked by the `lambda.Start` function call
-func Handler(ctx context.Context) (Response, error) {
-	rates, err := getDashUSDRates()
+func Handler(ctx context.Context, req events.APIGatewayProxyRequest) (Response, error) {
+	// answer CORS preflights without touching Redis
+	if req.HTTPMethod == "OPTIONS" {
+		return preflightResponse(req), nil
+	}
+
+	// scheduled warm-up invocations only ping Redis, to keep the container
+	// and its Redis connection warm
+	if isWarmup(req) {
+		return warmupResponse(req), nil
+	}
+
+	if !authorized(req) {
+		return unauthorizedResponse(req), nil
+	}
+
+	// the list of exchanges doesn't need Redis
+	if strings.HasSuffix(req.Path, "/exchanges") {
+		return exchangeListResponse(req)
+	}
+
+	params, err := parseServeParams(req)
+	if err != nil {
+		return errorResponse(req, 400, err.Error()), nil
+	}
+
+	// rates are read from the store selected with RATE_STORE
+	kind, err := ratestore.StoreKind()
+	if err != nil {
+		return serverError(req, err), nil
+	}
+	if params.AsOf != nil && kind != ratestore.StoreRedis {
+		return errorResponse(req, 400, "asOf is only supported with the Redis rate store"), nil
+	}
+
+	var store ratestore.RateStore
+	var redisCli *redis.Client
+	if kind == ratestore.StoreDynamoDB {
+		store, err = ratestore.NewDynamoStore()
+	} else {
+		// ensure required environment variables set
+		if err := ratestore.EnvCheck([]string{"REDIS_URL"}); err != nil {
+			return serverError(req, err), nil
+		}
+
+		// establish redis connection
+		redisCli, err = ratestore.RedisClient(os.Getenv("REDIS_URL"))
+		store = &ratestore.RedisStore{Client: redisCli}
+	}
+
+	// a single exchange's rate can be looked up without reading them all
+	if name, ok := req.PathParameters["exchange"]; ok {
+		if err != nil {
+			return serverError(req, err), nil
+		}
+		return singleRateResponse(ctx, req, store, name, params.Pretty)
+	}
+
+	var snap *rateSnapshot
+	staleFallback := false
+	if params.AsOf != nil {
+		// historical snapshots can only be read from Redis
+		if err == nil {
+			snap, err = loadAsOfSnapshot(redisCli, *params.AsOf)
+		}
+		if err != nil {
+			return serverError(req, err), nil
+		}
+	} else {
+		switch {
+		case err != nil:
+		case redisCli != nil:
+			snap, err = loadSnapshot(ctx, store, redisCli)
+		default:
+			snap, err = loadStoreSnapshot(ctx, store)
+		}
+		// if Redis is unreachable, serve the rates last read from it for a
+		// while
+		if err != nil {
+			if snap = fallbackSnapshot(time.Now()); snap == nil {
+				return serverError(req, err), nil
+			}
+			slog.Warn("redis unavailable, serving rates from memory", "error", err, "readAt", snap.readAt)
+			staleFallback = true
+		} else {
+			rememberSnapshot(snap)
+		}
+	}
+
+	// optionally tell clients to come back later rather than that there are
+	// no rates, e.g. before the first fetch or after Redis was flushed
+	if len(snap.rates) == 0 && ratestore.EnvBool("EMPTY_RATES_UNAVAILABLE") {
+		return noRatesResponse(req, snap.lastUpdated, time.Now()), nil
+	}
+
+	// fiat currency to express rates in, defaults to USD
+	base := params.Base
+	fxRate := 1.0
+	if base != "USD" {
+		var ok bool
+		fxRate, ok = snap.fxRates[base]
+		if !ok {
+			return errorResponse(req, 400, fmt.Sprintf("unsupported base currency '%s'", base)), nil
+		}
+	}
+
+	// copy the rates, since the snapshot may be reused by later requests
+	rates := append([]ratestore.DashUSDRate(nil), snap.rates...)
+	if params.Exchanges != nil {
+		rates = filterExchanges(rates, params.Exchanges)
+	}
+	sortRates(rates, params.Sort, params.Desc)
+
+	// drop rates from exchanges trading too little to be trusted, comparing
+	// volumes in USD before they're converted to the base currency
+	var lowVolume []string
+	if params.MinVolume > 0 {
+		rates, lowVolume = filterLowVolume(rates, params.MinVolume)
+	}
+
+	rates = convertRates(rates, base, fxRate)
+
+	// JSON can't represent NaN or infinity, so drop or clear them rather than
+	// fail the whole response
+	rates = sanitizeRates(rates)
+
+	// drop rates from exchanges which haven't been fetched recently, relative
+	// to the time asked for if any
+	now := time.Now()
+	if params.AsOf != nil {
+		now = *params.AsOf
+	}
+	var stale []string
+	if params.MaxAge > 0 {
+		rates, stale = filterStale(rates, now.Add(-time.Duration(params.MaxAge)*time.Second))
+	}
+
+	// how far from the median, in median absolute deviations, a price can
+	// be before it's left out of the consensus
+	outlierK := ratestore.EnvFloat("OUTLIER_MAD_K", defaultOutlierK)
+
+	// always return an array, even if no fetch has stored any rates yet
+	if rates == nil {
+		rates = []ratestore.DashUSDRate{}
+	}
+
+	contentType := "application/json"
+	var body []byte
+	switch {
+	case params.Prometheus:
+		contentType = prometheusContentType
+		body = prometheusMetrics(rates, base)
+	case params.Version == 1:
+		// the original response shape, a bare array of rates with only the
+		// original fields
+		for i := range rates {
+			rates[i].Prices = nil
+			rates[i].Pair = ""
+			rates[i].Slug = ""
+			rates[i].RawPrice = 0
+			rates[i].RawQuote = ""
+			rates[i].Change24h = nil
+			rates[i].FetchedAtAdjusted = false
+		}
+		page, _ := paginate(rates, params.Offset, params.Limit)
+		body, err = marshalBody(page, params.Pretty)
+		if err != nil {
+			return serverError(req, err), nil
+		}
+	default:
+		// the aggregate and counts cover every rate, not just the page
+		page, nextOffset := paginate(rates, params.Offset, params.Limit)
+		var ratesBody interface{} = page
+		switch {
+		case params.AggregateOnly:
+			ratesBody = nil
+			nextOffset = nil
+		case params.Shape == "map":
+			ratesBody = ratesByName(page)
+		}
+		body, err = marshalBody(responseEnvelope{
+			Version: responseVersion,
+			Data: serveResponse{
+				Base:            base,
+				BTCUSD:          snap.btcUSD,
+				BTCUSDFetchedAt: snap.btcUSDFetchedAt,
+				LastUpdated:     snap.lastUpdated,
+				StaleFallback:   staleFallback,
+				Rates:           ratesBody,
+				NextOffset:      nextOffset,
+				Stale:           stale,
+				LowVolume:       lowVolume,
+				LowVolumeCount:  len(lowVolume),
+				ExchangeCount:   len(rates),
+				ExpectedCount:   expectedCount(params.Exchanges),
+				rateAggregate:   aggregateRates(rates, outlierK, primaryExchanges(), exchangeWeights),
+			},
+		}, params.Pretty)
+		if err != nil {
+			return serverError(req, err), nil
+		}
+	}
+	resp := Response{
+		StatusCode:      200,
+		IsBase64Encoded: false,
+		Body:            string(body),
+		Headers:         responseHeaders(req, contentType),
+	}
+	addVary(resp.Headers, "Accept-Encoding")
+	if len(rates) == 0 {
+		resp.Headers["Warning"] = `199 - "no rates available"`
+	}
+
+	// let CDNs and browsers cache the response until the next fetch, unless
+	// it's a fallback which shouldn't outlive the Redis outage
+	resp.Headers["Cache-Control"] = fmt.Sprintf("public, max-age=%d", cacheMaxAge(rates, time.Now()))
+	if staleFallback {
+		resp.Headers["Cache-Control"] = "no-cache"
+		resp.Headers["Warning"] = `110 - "Response is Stale"`
+	}
+
+	// the body is identical for identical rate sets, since rates are sorted
+	// and JSON object keys are always in the same order
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+	resp.Headers["ETag"] = etag
+	if etagMatches(headerValue(req.Headers, "If-None-Match"), etag) {
+		resp.StatusCode = 304
+		resp.Body = ""
+		return resp, nil
+	}
+
+	// compress the body if the client accepts it
+	if strings.Contains(headerValue(req.Headers, "Accept-Encoding"), "gzip") {
+		gzipped, err := gzipBody(body)
+		if err != nil {
+			return serverError(req, err), nil
+		}
+		resp.Body = base64.StdEncoding.EncodeToString(gzipped)
+		resp.IsBase64Encoded = true
+		resp.Headers["Content-Encoding"] = "gzip"
+	}
+
+	return resp, nil
+}
+
+// cacheMaxAge returns how long, in seconds, the response may be cached. This is
+// SERVE_CACHE_MAX_AGE if set, or else the time until the next fetch is expected
+// given the most recent fetch time among the rates and FETCH_INTERVAL_SEC.
+func cacheMaxAge(rates []ratestore.DashUSDRate, now time.Time) int {
+	if maxAge := ratestore.EnvInt("SERVE_CACHE_MAX_AGE", -1); maxAge >= 0 {
+		return maxAge
+	}
+
+	var lastFetch time.Time
+	for _, rate := range rates {
+		if rate.FetchedAt.After(lastFetch) {
+			lastFetch = rate.FetchedAt
+		}
+	}
+	interval := time.Duration(ratestore.EnvInt("FETCH_INTERVAL_SEC", defaultFetchIntervalSec)) * time.Second
+	untilNext := lastFetch.Add(interval).Sub(now)
+	if untilNext <= 0 {
+		return 0
+	}
+	return int(untilNext.Seconds())
+}
+
+// noRatesResponse returns a 503 for req when there are no rates at all, with a
+// Retry-After header of the time until the next fetch is expected, going by
+// when the last one finished.
+func noRatesResponse(req events.APIGatewayProxyRequest, lastUpdated *time.Time, now time.Time) Response {
+	retryAfter := defaultRetryAfterSec
+	if lastUpdated != nil {
+		interval := time.Duration(ratestore.EnvInt("FETCH_INTERVAL_SEC", defaultFetchIntervalSec)) * time.Second
+		if untilNext := int(lastUpdated.Add(interval).Sub(now).Seconds()); untilNext > 0 {
+			retryAfter = untilNext
+		}
+	}
+
+	resp := errorResponse(req, 503, "no rates available")
+	resp.Headers["Retry-After"] = strconv.Itoa(retryAfter)
+	resp.Headers["Cache-Control"] = "no-cache"
+	return resp
+}
+
+// exchangeListResponse returns the display names of all exchanges rates are
+// fetched from, whether or not they currently have a rate.
+func exchangeListResponse(req events.APIGatewayProxyRequest) (Response, error) {
+	body, err := json.Marshal(exchanges.Names())
+	if err != nil {
+		return serverError(req, err), nil
+	}
+	resp := Response{
+		StatusCode:      200,
+		IsBase64Encoded: false,
+		Body:            string(body),
+		Headers:         responseHeaders(req, "application/json"),
+	}
+	return resp, nil
+}
+
+// singleRateResponse returns the cached rate for the named exchange, matched
+// case-insensitively, or a 404 if there isn't one.
+func singleRateResponse(ctx context.Context, req events.APIGatewayProxyRequest, store ratestore.RateStore, name string, pretty bool) (Response, error) {
+	displayName, ok := exchanges.Lookup(name)
+	if !ok {
+		return errorResponse(req, 404, fmt.Sprintf("unknown exchange '%s'", name)), nil
+	}
+	stored, err := store.Get(ctx, displayName)
+	if errors.Is(err, ratestore.ErrRateNotFound) {
+		return errorResponse(req, 404, fmt.Sprintf("no rate cached for '%s'", displayName)), nil
+	}
 	if err != nil {
-		return Response{StatusCode: 404}, err
+		return serverError(req, err), nil
+	}
+	rate, ok := sanitizeRate(stored)
+	if !ok {
+		return errorResponse(req, 404, fmt.Sprintf("no rate cached for '%s'", displayName)), nil
 	}
 
-	body, err := json.Marshal(rates)
+	body, err := marshalBody(rate, pretty)
 	if err != nil {
-		return Response{StatusCode: 404}, err
+		return serverError(req, err), nil
 	}
 	resp := Response{
 		StatusCode:      200,
 		IsBase64Encoded: false,
 		Body:            string(body),
+		Headers:         responseHeaders(req, "application/json"),
+	}
+	return resp, nil
+}
+
+// isWarmup reports whether req is a scheduled warm-up invocation, marked with
+// an X-Warmup: true header. Warm-ups skip the API key check, so the header is
+// only honored on the schedule event, which unlike every request through API
+// Gateway has no HTTP method.
+func isWarmup(req events.APIGatewayProxyRequest) bool {
+	if req.HTTPMethod != "" {
+		return false
+	}
+	warmup, _ := strconv.ParseBool(headerValue(req.Headers, "X-Warmup"))
+	return warmup
+}
+
+// warmupResponse creates the container's shared Redis client if need be and
+// pings it, leaving the connection open in its pool, so that the next real
+// request finds both ready. It returns {"warm": true}.
+func warmupResponse(req events.APIGatewayProxyRequest) Response {
+	if kind, _ := ratestore.StoreKind(); kind == ratestore.StoreRedis {
+		if err := ratestore.EnvCheck([]string{"REDIS_URL"}); err != nil {
+			return serverError(req, err)
+		}
+		// RedisClient pings the client, which opens a pooled connection
+		if _, err := ratestore.RedisClient(os.Getenv("REDIS_URL")); err != nil {
+			return serverError(req, err)
+		}
+	}
+
+	body, _ := json.Marshal(map[string]bool{"warm": true})
+	return Response{
+		StatusCode: 200,
+		Body:       string(body),
 		Headers: map[string]string{
 			"Content-Type":           "application/json",
 			"X-MyCompany-Func-Reply": "serve-handler",
-
-			// Set CORS headers
-			"Access-Control-Allow-Headers": "X-Requested-With,Content-Type",
-			"Access-Control-Allow-Origin":  "*",
-			"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS",
 		},
 	}
+}
 
-	return resp, nil
+// preflightResponse returns an empty response to a CORS preflight request,
+// carrying only the CORS headers
+func preflightResponse(req events.APIGatewayProxyRequest) Response {
+	headers := responseHeaders(req, "")
+	delete(headers, "Content-Type")
+	return Response{
+		StatusCode: 204,
+		Headers:    headers,
+	}
+}
+
+// responseHeaders returns the headers common to all successful serve
+// responses to req
+func responseHeaders(req events.APIGatewayProxyRequest, contentType string) map[string]string {
+	headers := map[string]string{
+		"Content-Type":           contentType,
+		"X-MyCompany-Func-Reply": "serve-handler",
+
+		// Set CORS headers
+		"Access-Control-Allow-Headers": "X-Requested-With,Content-Type," + apiKeyHeader,
+		"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS",
+	}
+
+	allowed := os.Getenv("ALLOWED_ORIGINS")
+	if strings.TrimSpace(allowed) == "" {
+		headers["Access-Control-Allow-Origin"] = "*"
+		return headers
+	}
+
+	// only echo the origin back if it's allowed, and make sure caches don't
+	// serve the response to other origins
+	addVary(headers, "Origin")
+	origin := headerValue(req.Headers, "Origin")
+	for _, o := range strings.Split(allowed, ",") {
+		if origin != "" && strings.TrimSpace(o) == origin {
+			headers["Access-Control-Allow-Origin"] = origin
+			break
+		}
+	}
+	return headers
+}
+
+// addVary adds the named request header to the Vary header in headers
+func addVary(headers map[string]string, name string) {
+	if vary := headers["Vary"]; vary != "" {
+		headers["Vary"] = vary + ", " + name
+		return
+	}
+	headers["Vary"] = name
+}
+
+// etagMatches reports whether the If-None-Match header value, which may list
+// several ETags, matches the given ETag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsPrometheus reports whether the request is for rates in the Prometheus
+// text exposition format rather than JSON.
+func wantsPrometheus(req events.APIGatewayProxyRequest) bool {
+	return strings.HasSuffix(req.Path, "/metrics") ||
+		req.QueryStringParameters["format"] == "prometheus"
+}
+
+// prometheusMetrics renders the rates as gauges in the Prometheus text
+// exposition format, labelled by exchange.
+func prometheusMetrics(rates []ratestore.DashUSDRate, base string) []byte {
+	var buf bytes.Buffer
+	cur := strings.ToLower(base)
+
+	priceName := "dash_rate_" + cur
+	fmt.Fprintf(&buf, "# HELP %s Dash price in %s.\n", priceName, base)
+	fmt.Fprintf(&buf, "# TYPE %s gauge\n", priceName)
+	for _, rate := range rates {
+		fmt.Fprintf(&buf, "%s{exchange=\"%s\"} %s\n", priceName,
+			escapeLabelValue(rate.Name), strconv.FormatFloat(rate.RateUSD, 'g', -1, 64))
+	}
+
+	volumeName := "dash_rate_volume_" + cur
+	fmt.Fprintf(&buf, "# HELP %s Dash 24h trading volume in %s.\n", volumeName, base)
+	fmt.Fprintf(&buf, "# TYPE %s gauge\n", volumeName)
+	for _, rate := range rates {
+		if rate.VolumeUSD == nil {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s{exchange=\"%s\"} %s\n", volumeName,
+			escapeLabelValue(rate.Name), strconv.FormatFloat(*rate.VolumeUSD, 'g', -1, 64))
+	}
+	return buf.Bytes()
+}
+
+// labelValueEscaper escapes the characters which aren't allowed as-is in a
+// Prometheus label value
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue makes an exchange name safe to use as a Prometheus label
+// value.
+func escapeLabelValue(val string) string {
+	return labelValueEscaper.Replace(val)
+}
+
+// gzipBody returns the gzip-compressed body
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// headerValue returns the value of the named request header. API Gateway
+// passes headers through with whatever casing the client used, so the lookup
+// is case-insensitive.
+func headerValue(headers map[string]string, name string) string {
+	for key, val := range headers {
+		if strings.EqualFold(key, name) {
+			return val
+		}
+	}
+	return ""
 }
 
 func main() {
+	logging.Setup()
+	exchangeWeights = parseExchangeWeights()
 	lambda.Start(Handler)
 }
 
-// getDashUSDRates gets exchange rates from Redis
-func getDashUSDRates() ([]DashUSDRate, error) {
-	var emptyRates []DashUSDRate
+// addChange24h populates Change24h on each rate by comparing its price to the
+// oldest price within the history window for the same exchange.
+func addChange24h(redisCli *redis.Client, rates []ratestore.DashUSDRate) error {
+	if len(rates) == 0 {
+		return nil
+	}
+	cutoff := strconv.FormatInt(time.Now().Add(-ratestore.HistoryWindow).Unix(), 10)
+
+	// fetch the oldest entry for each exchange in a single round-trip
+	pipe := redisCli.Pipeline()
+	cmds := make([]*redis.ZSliceCmd, len(rates))
+	for i, rate := range rates {
+		cmds[i] = pipe.ZRangeByScoreWithScores(ratestore.HistoryKey(rate.Name), redis.ZRangeBy{
+			Min:   cutoff,
+			Max:   "+inf",
+			Count: 1,
+		})
+	}
+	// one key holding something unexpected is skipped below, but if every
+	// command failed Redis is most likely unreachable
+	if _, err := pipe.Exec(); err != nil {
+		failed := 0
+		for _, cmd := range cmds {
+			if cmd.Err() != nil {
+				failed++
+			}
+		}
+		if failed == len(cmds) {
+			return err
+		}
+	}
 
-	// ensure required environment variables set
-	if err := envCheck([]string{"REDIS_URL"}); err != nil {
-		return emptyRates, err
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			slog.Warn("skipping invalid rate history", "key", ratestore.HistoryKey(rates[i].Name), "error", err)
+			continue
+		}
+		entries := cmd.Val()
+		if len(entries) == 0 {
+			continue
+		}
+		member, ok := entries[0].Member.(string)
+		if !ok {
+			continue
+		}
+		var oldest ratestore.DashUSDRate
+		if err := oldest.UnmarshalBinary([]byte(member)); err != nil {
+			slog.Warn("skipping invalid rate history", "key", ratestore.HistoryKey(rates[i].Name), "error", err)
+			continue
+		}
+		// the current rate is the only one in the window
+		if !oldest.FetchedAt.Before(rates[i].FetchedAt) || oldest.RateUSD == 0 {
+			continue
+		}
+		change := (rates[i].RateUSD - oldest.RateUSD) / oldest.RateUSD * 100
+		rates[i].Change24h = &change
 	}
+	return nil
+}
 
-	// establish redis connection
-	redisCli, err := redisCliCheck(os.Getenv("REDIS_URL"))
+// getFXRates gets the cached USD exchange rate for each supported fiat
+// currency from Redis
+func getFXRates(redisCli *redis.Client) (map[string]float64, error) {
+	res, err := redisCli.Get(ratestore.MetaKey("fx")).Result()
+	if err == redis.Nil {
+		return map[string]float64{}, nil
+	}
 	if err != nil {
-		return emptyRates, err
+		return nil, err
 	}
+	var fxRates map[string]float64
+	if err := json.Unmarshal([]byte(res), &fxRates); err != nil {
+		slog.Warn("skipping invalid FX rates", "key", ratestore.MetaKey("fx"), "error", err)
+		return map[string]float64{}, nil
+	}
+	return fxRates, nil
+}
 
-	// Get keys to loop thru
-	exchanges, err := redisCli.Keys("*").Result()
+// getBTCUSD gets the cached BTC/USD reference rate from Redis, or nil if it
+// isn't cached
+func getBTCUSD(redisCli *redis.Client) (*float64, error) {
+	rate, err := redisCli.Get(ratestore.MetaKey("btcusd")).Float64()
+	if err == redis.Nil {
+		return nil, nil
+	}
 	if err != nil {
-		return emptyRates, err
+		return nil, err
 	}
+	return &rate, nil
+}
 
-	// Get all rates from Redis
-	var ratesUSD []DashUSDRate
-	for _, exch := range exchanges {
-		res, err := redisCli.Get(exch).Result()
-		if err != nil {
-			return emptyRates, err
+// getMetaTime gets a time, such as that of the last successful fetch, from the
+// named reserved Redis key, or nil if it isn't recorded
+func getMetaTime(redisCli *redis.Client, name string) (*time.Time, error) {
+	val, err := redisCli.Get(ratestore.MetaKey(name)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, val)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// convertRates converts USD rates to the base currency given the number of
+// units of that currency per USD. Prices precomputed at fetch time are used
+// where available, and volumes are always converted with fxRate.
+func convertRates(rates []ratestore.DashUSDRate, base string, fxRate float64) []ratestore.DashUSDRate {
+	if base == "USD" {
+		return rates
+	}
+	converted := make([]ratestore.DashUSDRate, len(rates))
+	for i, rate := range rates {
+		if price, ok := rate.Prices[base]; ok {
+			rate.RateUSD = price
+		} else {
+			rate.RateUSD *= fxRate
 		}
-		var rate DashUSDRate
-		if err := rate.UnmarshalBinary([]byte(res)); err != nil {
-			return emptyRates, err
+		if rate.VolumeUSD != nil {
+			vol := *rate.VolumeUSD * fxRate
+			rate.VolumeUSD = &vol
 		}
-		ratesUSD = append(ratesUSD, rate)
+		converted[i] = rate
 	}
-	return ratesUSD, nil
+	return converted
 }
 
-// envCheck is called upon startup to ensure the required environment variables
-// are set
-func envCheck(reqd []string) error {
-	// ensure config vars set
-	missing := false
-	for _, env := range reqd {
-		val, ok := os.LookupEnv(env)
-		if !ok || (len(val) == 0) {
-			missing = true
+// sortRates stably sorts rates in place by the given field, which is one of
+// "name", "price" or "volume". When sorting by volume, rates with no reported
+// volume sort last regardless of order.
+func sortRates(rates []ratestore.DashUSDRate, field string, desc bool) {
+	sort.SliceStable(rates, func(i, j int) bool {
+		a, b := rates[i], rates[j]
+		if desc {
+			a, b = b, a
+		}
+		switch field {
+		case "price":
+			return a.RateUSD < b.RateUSD
+		case "volume":
+			if rates[i].VolumeUSD == nil || rates[j].VolumeUSD == nil {
+				return rates[i].VolumeUSD != nil && rates[j].VolumeUSD == nil
+			}
+			return *a.VolumeUSD < *b.VolumeUSD
+		default:
+			return a.Name < b.Name
 		}
+	})
+}
+
+// filterExchanges returns the rates from the named exchanges, matched
+// case-insensitively. Names which don't match any rate are ignored.
+func filterExchanges(rates []ratestore.DashUSDRate, names []string) []ratestore.DashUSDRate {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[strings.ToLower(strings.TrimSpace(name))] = true
 	}
-	if missing {
-		return fmt.Errorf("at least some required env var not set")
+
+	var filtered []ratestore.DashUSDRate
+	for _, rate := range rates {
+		if wanted[strings.ToLower(rate.Name)] || wanted[rate.Slug] {
+			filtered = append(filtered, rate)
+		}
 	}
-	return nil
+	return filtered
 }
 
-// redisCliCheck creates a Redis client and checks the connection via PING.
-func redisCliCheck(redisURL string) (*redis.Client, error) {
-	// establish redis connection
-	redisCli := redis.NewClient(&redis.Options{
-		Addr:     redisURL,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-	// ensure connected to redis
-	_, err := redisCli.Ping().Result()
-	if err != nil {
-		err := fmt.Errorf("error: unable to ping redis at '%s'", redisURL)
-		return nil, err
+// expectedCount returns the number of enabled exchanges, or if names is
+// non-nil, the number of them which are named (case-insensitively).
+func expectedCount(names []string) int {
+	enabled := exchanges.Names()
+	if names == nil {
+		return len(enabled)
+	}
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	count := 0
+	for _, name := range enabled {
+		if wanted[strings.ToLower(name)] || wanted[exchanges.Slug(name)] {
+			count++
+		}
+	}
+	return count
+}
+
+// filterStale splits rates into those fetched at or after the cutoff, and the
+// names of the exchanges whose rates were fetched before it.
+func filterStale(rates []ratestore.DashUSDRate, cutoff time.Time) ([]ratestore.DashUSDRate, []string) {
+	var fresh []ratestore.DashUSDRate
+	var stale []string
+	for _, rate := range rates {
+		if rate.FetchedAt.Before(cutoff) {
+			stale = append(stale, rate.Name)
+			continue
+		}
+		fresh = append(fresh, rate)
+	}
+	return fresh, stale
+}
+
+// paginate returns the page of limit rates starting at offset, or all those
+// after offset if limit is 0, and the offset of the next page, nil if there
+// are no more rates.
+func paginate(rates []ratestore.DashUSDRate, offset, limit int) ([]ratestore.DashUSDRate, *int) {
+	if offset >= len(rates) {
+		return []ratestore.DashUSDRate{}, nil
+	}
+	end := len(rates)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	if end == len(rates) {
+		return rates[offset:], nil
+	}
+	return rates[offset:end], &end
+}
+
+// sanitizeRates returns the rates with a finite price, with any other NaN or
+// infinite values cleared, see sanitizeRate.
+func sanitizeRates(rates []ratestore.DashUSDRate) []ratestore.DashUSDRate {
+	var sanitized []ratestore.DashUSDRate
+	for _, rate := range rates {
+		if rate, ok := sanitizeRate(rate); ok {
+			sanitized = append(sanitized, rate)
+		}
+	}
+	return sanitized
+}
+
+// sanitizeRate clears the optional values of rate which are NaN or infinite,
+// which JSON can't represent, and reports false if its price is, since then
+// the rate is unusable. Either case is logged.
+func sanitizeRate(rate ratestore.DashUSDRate) (ratestore.DashUSDRate, bool) {
+	if !isFinite(rate.RateUSD) {
+		slog.Warn("dropping rate with non-finite price", "exchange", rate.Name, "price", fmt.Sprint(rate.RateUSD))
+		return rate, false
+	}
+	if rate.VolumeUSD != nil && !isFinite(*rate.VolumeUSD) {
+		slog.Warn("clearing non-finite volume", "exchange", rate.Name, "volume", fmt.Sprint(*rate.VolumeUSD))
+		rate.VolumeUSD = nil
 	}
-	return redisCli, nil
+	if rate.Change24h != nil && !isFinite(*rate.Change24h) {
+		slog.Warn("clearing non-finite change", "exchange", rate.Name, "change24h", fmt.Sprint(*rate.Change24h))
+		rate.Change24h = nil
+	}
+	if !isFinite(rate.RawPrice) {
+		slog.Warn("clearing non-finite raw price", "exchange", rate.Name, "rawPrice", fmt.Sprint(rate.RawPrice))
+		rate.RawPrice = 0
+	}
+	for currency, price := range rate.Prices {
+		if isFinite(price) {
+			continue
+		}
+		slog.Warn("clearing non-finite price", "exchange", rate.Name, "currency", currency, "price", fmt.Sprint(price))
+		// copy the prices, since the map may be shared with a cached snapshot
+		prices := make(map[string]float64, len(rate.Prices))
+		for c, p := range rate.Prices {
+			if isFinite(p) {
+				prices[c] = p
+			}
+		}
+		rate.Prices = prices
+		break
+	}
+	return rate, true
+}
+
+// isFinite reports whether f is neither NaN nor infinite.
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// ratesByName returns rates keyed by exchange name. Should an exchange appear
+// more than once, the first rate is kept and the duplicate is logged.
+func ratesByName(rates []ratestore.DashUSDRate) map[string]ratestore.DashUSDRate {
+	byName := make(map[string]ratestore.DashUSDRate, len(rates))
+	for _, rate := range rates {
+		if _, ok := byName[rate.Name]; ok {
+			slog.Warn("duplicate exchange rate, keeping the first", "exchange", rate.Name)
+			continue
+		}
+		byName[rate.Name] = rate
+	}
+	return byName
 }
 
-// DashUSDRate is an entry for output to the exchange rate API
-type DashUSDRate struct {
-	Name      string    `json:"exchange"`
-	RateUSD   float64   `json:"price"`
-	VolumeUSD *float64  `json:"volume,omitempty"`
-	FetchedAt time.Time `json:"fetchedAt"`
+// filterLowVolume splits rates into those with a USD volume of at least
+// minVolume, and the names of the exchanges whose volume is lower or missing.
+func filterLowVolume(rates []ratestore.DashUSDRate, minVolume float64) ([]ratestore.DashUSDRate, []string) {
+	var liquid []ratestore.DashUSDRate
+	var low []string
+	for _, rate := range rates {
+		if rate.VolumeUSD == nil || *rate.VolumeUSD < minVolume {
+			low = append(low, rate.Name)
+			continue
+		}
+		liquid = append(liquid, rate)
+	}
+	return liquid, low
 }
 
-// MarshalBinary is part of the encoding.BinaryMarshaler interface
-func (rate *DashUSDRate) MarshalBinary() ([]byte, error) {
-	return json.Marshal(rate)
+// serverError logs err and returns a response to req with a generic JSON error
+// body, so internal details aren't leaked to the client. Redis connectivity
+// failures are reported as 503, anything else as 500.
+func serverError(req events.APIGatewayProxyRequest, err error) Response {
+	slog.Error("internal error", "error", err)
+	if errors.Is(err, ratestore.ErrRedisUnavailable) {
+		return errorResponse(req, 503, "service unavailable")
+	}
+	return errorResponse(req, 500, "internal server error")
 }
 
-// UnmarshalBinary is part of the encoding.BinaryUnmarshaler interface
-func (rate *DashUSDRate) UnmarshalBinary(data []byte) error {
-	return json.Unmarshal(data, rate)
+// marshalBody marshals a response body to JSON, indented if pretty is set for
+// easier reading when debugging.
+func marshalBody(v interface{}, pretty bool) ([]byte, error) {
+	if pretty {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
+
+// errorResponse returns a response to req with the given status code and a
+// JSON body describing the error. It carries the CORS headers, so a browser
+// client can read the error.
+func errorResponse(req events.APIGatewayProxyRequest, statusCode int, message string) Response {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	return Response{
+		StatusCode: statusCode,
+		Body:       string(body),
+		Headers:    responseHeaders(req, "application/json"),
+	}
+}
+
+// responseEnvelope wraps the serve response body with the version of its
+// schema, so the schema can change without breaking clients
+type responseEnvelope struct {
+	Version int           `json:"version"`
+	Data    serveResponse `json:"data"`
+}
+
+// serveResponse is the body returned by the serve handler. Despite the field
+// names of DashUSDRate, prices and volumes are expressed in the Base currency.
+type serveResponse struct {
+	Base string `json:"base"`
+
+	// Rates is either a []ratestore.DashUSDRate or, for shape=map, a
+	// map[string]ratestore.DashUSDRate keyed by exchange name. It's nil, and
+	// left out, when only the aggregate was asked for.
+	Rates interface{} `json:"rates,omitempty"`
+
+	// NextOffset is the offset of the next page of rates, nil if Rates
+	// holds the last of them
+	NextOffset *int `json:"nextOffset,omitempty"`
+
+	// BTCUSD is the BTC/USD reference rate used to convert BTC-quoted rates,
+	// always in USD regardless of Base
+	BTCUSD *float64 `json:"btcUsd"`
+
+	// BTCUSDFetchedAt is when the BTC/USD reference rate was fetched, which
+	// all BTC-quoted conversions share
+	BTCUSDFetchedAt *time.Time `json:"btcUsdFetchedAt"`
+
+	// StaleFallback is set when Redis was unreachable and the rates were
+	// served from memory instead
+	StaleFallback bool `json:"staleFallback,omitempty"`
+
+	// LastUpdated is when the last successful fetch finished, nil if there
+	// hasn't been one
+	LastUpdated *time.Time `json:"lastUpdated"`
+
+	// Stale lists exchanges left out of Rates because they were fetched too
+	// long ago
+	Stale []string `json:"stale,omitempty"`
+
+	// LowVolume lists exchanges left out of Rates because their USD volume was
+	// below the minimum, or they didn't report one, and LowVolumeCount is how
+	// many there were
+	LowVolume      []string `json:"lowVolume,omitempty"`
+	LowVolumeCount int      `json:"lowVolumeCount"`
+
+	// ExchangeCount is the number of exchanges whose rates are returned and
+	// make up the aggregate, and ExpectedCount the number of enabled
+	// exchanges asked for, so clients can tell how complete the data is
+	ExchangeCount int `json:"exchangeCount"`
+	ExpectedCount int `json:"expectedCount"`
+	rateAggregate
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// testRedis starts a miniredis server holding the given rates and points
+// REDIS_URL at it. The in-memory snapshot is forgotten when the test ends.
+func testRedis(t *testing.T, rates ...ratestore.DashUSDRate) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+mr.Addr())
+	t.Cleanup(func() { rememberSnapshot(nil) })
+	for i := range rates {
+		data, err := rates[i].MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr.Set(ratestore.RateKey(rates[i].Name), string(data))
+	}
+	return mr
+}
+
+// getRates returns a GET request for all rates
+func getRates() events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/rates"}
+}
+
+// checkHeaders fails the test unless headers is exactly want
+func checkHeaders(t *testing.T, headers, want map[string]string) {
+	t.Helper()
+	for name, val := range want {
+		if got, ok := headers[name]; !ok || got != val {
+			t.Errorf("%s = %q, want %q", name, got, val)
+		}
+	}
+	for name, val := range headers {
+		if _, ok := want[name]; !ok {
+			t.Errorf("unexpected header %s: %q", name, val)
+		}
+	}
+}
+
+func TestHandlerHeaders(t *testing.T) {
+	t.Setenv("SERVE_CACHE_MAX_AGE", "60")
+	testRedis(t, ratestore.DashUSDRate{Name: "Kraken", RateUSD: 75, FetchedAt: time.Now().UTC()})
+	ctx := context.Background()
+	cors := map[string]string{
+		"Access-Control-Allow-Headers": "X-Requested-With,Content-Type,X-Api-Key",
+		"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS",
+		"Access-Control-Allow-Origin":  "*",
+	}
+
+	t.Run("GET", func(t *testing.T) {
+		resp, err := Handler(ctx, getRates())
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("Handler = %d, %v", resp.StatusCode, err)
+		}
+		checkHeaders(t, resp.Headers, map[string]string{
+			"Content-Type":                 "application/json",
+			"X-MyCompany-Func-Reply":       "serve-handler",
+			"Access-Control-Allow-Headers": cors["Access-Control-Allow-Headers"],
+			"Access-Control-Allow-Methods": cors["Access-Control-Allow-Methods"],
+			"Access-Control-Allow-Origin":  cors["Access-Control-Allow-Origin"],
+			"Vary":                         "Accept-Encoding",
+			"Cache-Control":                "public, max-age=60",
+			"ETag":                         fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(resp.Body))),
+		})
+	})
+
+	t.Run("GET from an allowed origin", func(t *testing.T) {
+		t.Setenv("ALLOWED_ORIGINS", "https://a.example, https://b.example")
+		req := getRates()
+		req.Headers = map[string]string{"Origin": "https://b.example"}
+		resp, err := Handler(ctx, req)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("Handler = %d, %v", resp.StatusCode, err)
+		}
+		checkHeaders(t, resp.Headers, map[string]string{
+			"Content-Type":                 "application/json",
+			"X-MyCompany-Func-Reply":       "serve-handler",
+			"Access-Control-Allow-Headers": cors["Access-Control-Allow-Headers"],
+			"Access-Control-Allow-Methods": cors["Access-Control-Allow-Methods"],
+			"Access-Control-Allow-Origin":  "https://b.example",
+			"Vary":                         "Origin, Accept-Encoding",
+			"Cache-Control":                "public, max-age=60",
+			"ETag":                         fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(resp.Body))),
+		})
+	})
+
+	t.Run("OPTIONS", func(t *testing.T) {
+		resp, err := Handler(ctx, events.APIGatewayProxyRequest{HTTPMethod: "OPTIONS", Path: "/rates"})
+		if err != nil || resp.StatusCode != 204 {
+			t.Fatalf("Handler = %d, %v", resp.StatusCode, err)
+		}
+		if resp.Body != "" {
+			t.Errorf("preflight body = %q, want none", resp.Body)
+		}
+		checkHeaders(t, resp.Headers, map[string]string{
+			"X-MyCompany-Func-Reply":       "serve-handler",
+			"Access-Control-Allow-Headers": cors["Access-Control-Allow-Headers"],
+			"Access-Control-Allow-Methods": cors["Access-Control-Allow-Methods"],
+			"Access-Control-Allow-Origin":  cors["Access-Control-Allow-Origin"],
+		})
+	})
+
+	t.Run("error", func(t *testing.T) {
+		req := getRates()
+		req.QueryStringParameters = map[string]string{"base": "XYZ"}
+		resp, err := Handler(ctx, req)
+		if err != nil || resp.StatusCode != 400 {
+			t.Fatalf("Handler = %d, %v", resp.StatusCode, err)
+		}
+		checkHeaders(t, resp.Headers, map[string]string{
+			"Content-Type":                 "application/json",
+			"X-MyCompany-Func-Reply":       "serve-handler",
+			"Access-Control-Allow-Headers": cors["Access-Control-Allow-Headers"],
+			"Access-Control-Allow-Methods": cors["Access-Control-Allow-Methods"],
+			"Access-Control-Allow-Origin":  "*",
+		})
+	})
+}
+
+func TestHandlerV1Keys(t *testing.T) {
+	change, vol := 2.5, 1e6
+	testRedis(t, ratestore.DashUSDRate{
+		Name:              "Kraken",
+		Slug:              "kraken",
+		RateUSD:           75,
+		VolumeUSD:         &vol,
+		FetchedAt:         time.Now().UTC(),
+		Pair:              "DASH/USD",
+		RawPrice:          75,
+		RawQuote:          "USD",
+		Change24h:         &change,
+		Prices:            map[string]float64{"USD": 75, "EUR": 70},
+		FetchedAtAdjusted: true,
+	})
+	req := getRates()
+	req.QueryStringParameters = map[string]string{"v": "1"}
+	resp, err := Handler(context.Background(), req)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Handler = %d, %v", resp.StatusCode, err)
+	}
+
+	var rates []map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(resp.Body), &rates); err != nil {
+		t.Fatalf("v1 body %s: %v", resp.Body, err)
+	}
+	if len(rates) != 1 {
+		t.Fatalf("v1 body = %s, want one rate", resp.Body)
+	}
+	var keys []string
+	for key := range rates[0] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if want := []string{"exchange", "fetchedAt", "price", "volume"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("v1 rate keys = %v, want %v", keys, want)
+	}
+}
+
+func TestHandlerWarmup(t *testing.T) {
+	testRedis(t)
+	t.Setenv("SERVE_API_KEYS", "secret")
+	ctx := context.Background()
+	warmup := map[string]string{"X-Warmup": "true"}
+
+	// the scheduled event
+	resp, err := Handler(ctx, events.APIGatewayProxyRequest{Headers: warmup})
+	if err != nil || resp.StatusCode != 200 || resp.Body != `{"warm":true}` {
+		t.Errorf("scheduled warm-up = %d %s, %v", resp.StatusCode, resp.Body, err)
+	}
+
+	// a client can't use the header to get past the API key check
+	req := getRates()
+	req.Headers = warmup
+	resp, err = Handler(ctx, req)
+	if err != nil || resp.StatusCode != 401 {
+		t.Errorf("warm-up through API Gateway = %d, %v, want 401", resp.StatusCode, err)
+	}
+}
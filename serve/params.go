@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maxLimit is the most rates a single page can be asked for with limit
+const maxLimit = 500
+
+// serveParams are the validated query parameters of a serve request, with
+// defaults filled in
+type serveParams struct {
+	// Base is the upper-cased fiat currency to express rates in
+	Base string
+
+	// Exchanges, if non-nil, are the only exchanges to return rates for
+	Exchanges []string
+
+	// Sort is the field to sort rates by, one of "name", "price" or "volume"
+	Sort string
+	Desc bool
+
+	// Shape is how rates are returned, "array" or "map"
+	Shape string
+
+	// MinVolume is the USD volume below which rates are dropped, 0 for none
+	MinVolume float64
+
+	// MaxAge is the age in seconds beyond which rates are dropped, 0 for none
+	MaxAge int
+
+	// Prometheus is set when the response should be Prometheus metrics
+	Prometheus bool
+
+	// AggregateOnly is set when only the aggregate prices should be returned,
+	// without the rates of each exchange
+	AggregateOnly bool
+
+	// AsOf, if non-nil, is the time to return each exchange's rate as of,
+	// from its price history, rather than its latest rate
+	AsOf *time.Time
+
+	// Pretty is set when the JSON body should be indented, for debugging
+	Pretty bool
+
+	// Limit is the most rates to return, 0 for all of them, starting from
+	// Offset in the sorted rates
+	Limit  int
+	Offset int
+
+	// Version is the response schema version, 1 for the bare array of rates
+	// or responseVersion for the envelope
+	Version int
+}
+
+// parseServeParams parses and validates the query parameters of req, returning
+// an error describing the first malformed one. Unknown parameters are ignored.
+func parseServeParams(req events.APIGatewayProxyRequest) (serveParams, error) {
+	query := req.QueryStringParameters
+	params := serveParams{
+		Base:       "USD",
+		Sort:       "name",
+		Shape:      "array",
+		MinVolume:  ratestore.EnvFloat("MIN_VOLUME_USD", 0),
+		MaxAge:     ratestore.EnvInt("MAX_RATE_AGE_SEC", 0),
+		Prometheus: wantsPrometheus(req),
+		Version:    responseVersion,
+	}
+
+	if val := query["base"]; val != "" {
+		params.Base = strings.ToUpper(val)
+		if len(params.Base) != 3 || strings.Trim(params.Base, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return params, fmt.Errorf("invalid base '%s'", val)
+		}
+	}
+
+	if val, ok := query["exchanges"]; ok {
+		params.Exchanges = strings.Split(val, ",")
+	}
+
+	if val := query["sort"]; val != "" {
+		if val != "name" && val != "price" && val != "volume" {
+			return params, fmt.Errorf("invalid sort '%s'", val)
+		}
+		params.Sort = val
+	}
+	if val := query["order"]; val != "" {
+		if val != "asc" && val != "desc" {
+			return params, fmt.Errorf("invalid order '%s'", val)
+		}
+		params.Desc = val == "desc"
+	}
+
+	if val := query["shape"]; val != "" {
+		if val != "array" && val != "map" {
+			return params, fmt.Errorf("invalid shape '%s'", val)
+		}
+		params.Shape = val
+	}
+
+	if val, ok := query["minVolume"]; ok {
+		minVolume, err := strconv.ParseFloat(val, 64)
+		if err != nil || minVolume < 0 || math.IsNaN(minVolume) || math.IsInf(minVolume, 0) {
+			return params, fmt.Errorf("invalid minVolume '%s'", val)
+		}
+		params.MinVolume = minVolume
+	}
+
+	if val, ok := query["maxAge"]; ok {
+		maxAge, err := strconv.Atoi(val)
+		if err != nil || maxAge < 0 {
+			return params, fmt.Errorf("invalid maxAge '%s'", val)
+		}
+		params.MaxAge = maxAge
+	}
+
+	if val := query["fields"]; val != "" {
+		if val != "aggregate" {
+			return params, fmt.Errorf("invalid fields '%s'", val)
+		}
+		params.AggregateOnly = true
+	}
+	if val := query["summary"]; val != "" {
+		summary, err := strconv.ParseBool(val)
+		if err != nil {
+			return params, fmt.Errorf("invalid summary '%s'", val)
+		}
+		params.AggregateOnly = params.AggregateOnly || summary
+	}
+
+	if val := query["asOf"]; val != "" {
+		asOf, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return params, fmt.Errorf("invalid asOf '%s'", val)
+		}
+		params.AsOf = &asOf
+	}
+
+	if val, ok := query["limit"]; ok {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return params, fmt.Errorf("invalid limit '%s', must be 1 to %d", val, maxLimit)
+		}
+		params.Limit = limit
+	}
+	if val, ok := query["offset"]; ok {
+		offset, err := strconv.Atoi(val)
+		if err != nil || offset < 0 {
+			return params, fmt.Errorf("invalid offset '%s'", val)
+		}
+		params.Offset = offset
+	}
+
+	if val := query["pretty"]; val != "" {
+		pretty, err := strconv.ParseBool(val)
+		if err != nil {
+			return params, fmt.Errorf("invalid pretty '%s'", val)
+		}
+		params.Pretty = pretty
+	}
+
+	if val := query["v"]; val != "" {
+		version, err := strconv.Atoi(val)
+		if err != nil || (version != 1 && version != responseVersion) {
+			return params, fmt.Errorf("invalid v '%s'", val)
+		}
+		params.Version = version
+	}
+
+	return params, nil
+}
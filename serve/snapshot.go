@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/projects/sls-dash-rate-service/internal/exchanges"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// defaultFallbackMaxAgeSec is how old the in-memory copy of the rates may be
+// and still be served when Redis is unreachable, if SERVE_FALLBACK_MAX_AGE_SEC
+// is unset
+const defaultFallbackMaxAgeSec = 300
+
+// rateSnapshot is everything serve reads from Redis to answer a request for
+// rates
+type rateSnapshot struct {
+	// rates are all cached rates, with Change24h populated
+	rates []ratestore.DashUSDRate
+
+	fxRates         map[string]float64
+	btcUSD          *float64
+	btcUSDFetchedAt *time.Time
+	lastUpdated     *time.Time
+
+	// readAt is when the snapshot was read from Redis
+	readAt time.Time
+}
+
+// lastSnapshot is the most recent snapshot read from Redis. Lambda reuses
+// containers, so it survives between invocations and can be served if Redis
+// briefly becomes unreachable.
+var lastSnapshot struct {
+	sync.Mutex
+	snap *rateSnapshot
+}
+
+// loadSnapshot reads the cached rates from store, a RedisStore, and the values
+// which go with them from Redis.
+func loadSnapshot(ctx context.Context, store ratestore.RateStore, redisCli *redis.Client) (*rateSnapshot, error) {
+	snap := &rateSnapshot{readAt: time.Now()}
+
+	var err error
+	if snap.fxRates, err = getFXRates(redisCli); err != nil {
+		return nil, err
+	}
+	if snap.rates, err = store.GetAll(ctx); err != nil {
+		return nil, err
+	}
+	if err := addChange24h(redisCli, snap.rates); err != nil {
+		return nil, err
+	}
+	if snap.btcUSD, err = getBTCUSD(redisCli); err != nil {
+		return nil, err
+	}
+	if snap.btcUSDFetchedAt, err = getMetaTime(redisCli, "btcusdFetchedAt"); err != nil {
+		return nil, err
+	}
+	if snap.lastUpdated, err = getMetaTime(redisCli, "lastFetchAt"); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// loadStoreSnapshot reads the rates from a store other than Redis. Only the
+// rates are kept there, so the FX rates are worked out from the fiat prices
+// stored with them, and the rest of the snapshot is left empty.
+func loadStoreSnapshot(ctx context.Context, store ratestore.RateStore) (*rateSnapshot, error) {
+	snap := &rateSnapshot{readAt: time.Now(), fxRates: make(map[string]float64)}
+
+	var err error
+	if snap.rates, err = store.GetAll(ctx); err != nil {
+		return nil, err
+	}
+	for _, rate := range snap.rates {
+		usd := rate.Prices["USD"]
+		if usd <= 0 {
+			continue
+		}
+		for cur, price := range rate.Prices {
+			if cur != "USD" {
+				snap.fxRates[cur] = price / usd
+			}
+		}
+		break
+	}
+	return snap, nil
+}
+
+// loadAsOfSnapshot reads the rate of each enabled exchange as it was at asOf:
+// the latest one in its price history fetched at or before then. Exchanges
+// with no such rate are left out. Only the rates and FX rates are filled in,
+// the FX rates being the current ones, which are only needed for rates stored
+// without their fiat prices.
+func loadAsOfSnapshot(redisCli *redis.Client, asOf time.Time) (*rateSnapshot, error) {
+	snap := &rateSnapshot{readAt: time.Now()}
+
+	var err error
+	if snap.fxRates, err = getFXRates(redisCli); err != nil {
+		return nil, err
+	}
+
+	names := exchanges.Names()
+	maxScore := strconv.FormatInt(asOf.Unix(), 10)
+	pipe := redisCli.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(names))
+	for i, name := range names {
+		cmds[i] = pipe.ZRevRangeByScore(ratestore.HistoryKey(name), redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   maxScore,
+			Count: 1,
+		})
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	for i, cmd := range cmds {
+		vals := cmd.Val()
+		if len(vals) == 0 {
+			continue
+		}
+		var rate ratestore.DashUSDRate
+		if err := rate.UnmarshalBinary([]byte(vals[0])); err != nil {
+			slog.Warn("skipping corrupt history entry", "exchange", names[i], "error", err)
+			continue
+		}
+		snap.rates = append(snap.rates, rate)
+	}
+	return snap, nil
+}
+
+// rememberSnapshot keeps snap in memory as the fallback for when Redis is
+// unreachable.
+func rememberSnapshot(snap *rateSnapshot) {
+	lastSnapshot.Lock()
+	defer lastSnapshot.Unlock()
+	lastSnapshot.snap = snap
+}
+
+// fallbackSnapshot returns the last snapshot read from Redis, or nil if there
+// isn't one or it's older than SERVE_FALLBACK_MAX_AGE_SEC (0 disables the
+// fallback).
+func fallbackSnapshot(now time.Time) *rateSnapshot {
+	maxAge := time.Duration(ratestore.EnvInt("SERVE_FALLBACK_MAX_AGE_SEC", defaultFallbackMaxAgeSec)) * time.Second
+
+	lastSnapshot.Lock()
+	defer lastSnapshot.Unlock()
+	snap := lastSnapshot.snap
+	if snap == nil || maxAge <= 0 || now.Sub(snap.readAt) > maxAge {
+		return nil
+	}
+	return snap
+}
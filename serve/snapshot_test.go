@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+func TestFallbackSnapshot(t *testing.T) {
+	t.Cleanup(func() { rememberSnapshot(nil) })
+	now := time.Now()
+
+	if snap := fallbackSnapshot(now); snap != nil {
+		t.Fatal("fallback snapshot before any was remembered")
+	}
+	rememberSnapshot(&rateSnapshot{readAt: now.Add(-time.Minute)})
+	if snap := fallbackSnapshot(now); snap == nil {
+		t.Error("no fallback snapshot within the max age")
+	}
+	if snap := fallbackSnapshot(now.Add(defaultFallbackMaxAgeSec * time.Second)); snap != nil {
+		t.Error("fallback snapshot older than the max age")
+	}
+	t.Setenv("SERVE_FALLBACK_MAX_AGE_SEC", "0")
+	if snap := fallbackSnapshot(now); snap != nil {
+		t.Error("fallback snapshot with the fallback disabled")
+	}
+}
+
+func TestHandlerServesSnapshotWhenStoreFails(t *testing.T) {
+	rate := testRate("Kraken", 75, 0)
+	rate.FetchedAt = time.Now().UTC()
+	mr := testRedis(t, rate)
+	ctx := context.Background()
+
+	resp, err := Handler(ctx, getRates())
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Handler = %d, %v", resp.StatusCode, err)
+	}
+	if resp.Headers["Warning"] != "" {
+		t.Errorf("Warning = %q with Redis up", resp.Headers["Warning"])
+	}
+
+	// Redis goes away, so the rates read above are served from memory
+	mr.Close()
+	resp, err = Handler(ctx, getRates())
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Handler with Redis down = %d, %v", resp.StatusCode, err)
+	}
+	if got := resp.Headers["Warning"]; got != `110 - "Response is Stale"` {
+		t.Errorf("Warning = %q, want stale", got)
+	}
+	if got := resp.Headers["Cache-Control"]; got != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", got)
+	}
+	var body struct {
+		Data struct {
+			StaleFallback bool                    `json:"staleFallback"`
+			Rates         []ratestore.DashUSDRate `json:"rates"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatal(err)
+	}
+	if !body.Data.StaleFallback || len(body.Data.Rates) != 1 || body.Data.Rates[0].RateUSD != 75 {
+		t.Errorf("body = %s, want the remembered Kraken rate", resp.Body)
+	}
+
+	// once the snapshot is too old, the outage is reported
+	t.Setenv("SERVE_FALLBACK_MAX_AGE_SEC", "0")
+	resp, _ = Handler(ctx, getRates())
+	if resp.StatusCode != 503 {
+		t.Errorf("Handler with no usable snapshot = %d, want 503", resp.StatusCode)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+
+	"github.com/projects/sls-dash-rate-service/internal/logging"
+	"github.com/projects/sls-dash-rate-service/internal/push"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// Response is of type APIGatewayProxyResponse, which API Gateway also expects
+// from WebSocket route integrations
+type Response events.APIGatewayProxyResponse
+
+// WebSocketRequest is the API Gateway WebSocket event, with only the fields
+// used here. The version of aws-lambda-go this module uses predates WebSocket
+// APIs, so it has no type for it.
+type WebSocketRequest struct {
+	RequestContext struct {
+		RouteKey     string `json:"routeKey"`
+		ConnectionID string `json:"connectionId"`
+	} `json:"requestContext"`
+	Body string `json:"body"`
+}
+
+// WebSocketHandler is our lambda handler invoked by the `lambda.Start`
+// function call. Clients are remembered on $connect and forgotten on
+// $disconnect, and fetch pushes rates to them after each run. Nothing can be
+// sent to a client until $connect has returned, so a new client would get
+// nothing until the next run. Instead, clients send {"action": "hello"} once
+// connected (the hello route), which is answered with the current rates. Any
+// other message ($default) is answered with an error saying so.
+func WebSocketHandler(ctx context.Context, req WebSocketRequest) (Response, error) {
+	// ensure required environment variables set
+	if err := ratestore.EnvCheck([]string{"REDIS_URL"}); err != nil {
+		return serverError(err), nil
+	}
+
+	// establish redis connection
+	redisCli, err := ratestore.RedisClient(os.Getenv("REDIS_URL"))
+	if err != nil {
+		return serverError(err), nil
+	}
+
+	connectionID := req.RequestContext.ConnectionID
+	switch req.RequestContext.RouteKey {
+	case "$connect":
+		if err := push.AddConnection(redisCli, connectionID); err != nil {
+			return serverError(err), nil
+		}
+		slog.Info("websocket client connected", "connectionId", connectionID)
+		return Response{StatusCode: 200}, nil
+	case "$disconnect":
+		if err := push.RemoveConnection(redisCli, connectionID); err != nil {
+			return serverError(err), nil
+		}
+		slog.Info("websocket client disconnected", "connectionId", connectionID)
+		return Response{StatusCode: 200}, nil
+	case "hello":
+	default:
+		body, _ := json.Marshal(map[string]string{"error": `unknown action, send {"action": "hello"} for the current rates`})
+		return Response{StatusCode: 400, Body: string(body)}, nil
+	}
+
+	rates, err := ratestore.GetRates(redisCli)
+	if err != nil {
+		return serverError(err), nil
+	}
+	body, err := push.RatesMessage(rates)
+	if err != nil {
+		return serverError(err), nil
+	}
+	return Response{StatusCode: 200, Body: string(body)}, nil
+}
+
+func main() {
+	logging.Setup()
+	lambda.Start(WebSocketHandler)
+}
+
+// serverError logs err and returns a response with a generic JSON error body,
+// so internal details aren't leaked to the client.
+func serverError(err error) Response {
+	slog.Error("internal error", "error", err)
+	body, _ := json.Marshal(map[string]string{"error": "internal server error"})
+	return Response{StatusCode: 500, Body: string(body)}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/projects/sls-dash-rate-service/internal/push"
+	"github.com/projects/sls-dash-rate-service/internal/ratestore"
+)
+
+// request returns a WebSocket event for the given route
+func request(route, connectionID, body string) WebSocketRequest {
+	var req WebSocketRequest
+	req.RequestContext.RouteKey = route
+	req.RequestContext.ConnectionID = connectionID
+	req.Body = body
+	return req
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+mr.Addr())
+
+	rate := ratestore.DashUSDRate{Name: "Kraken", RateUSD: 100, FetchedAt: time.Now().UTC()}
+	data, err := rate.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.Set(ratestore.RateKey(rate.Name), string(data))
+
+	ctx := context.Background()
+	resp, err := WebSocketHandler(ctx, request("$connect", "abc", ""))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("$connect = %d, %v", resp.StatusCode, err)
+	}
+	if ok, _ := mr.SIsMember(push.ConnectionsKey(), "abc"); !ok {
+		t.Error("client not remembered on $connect")
+	}
+
+	// a new client asks for the rates straight after connecting
+	resp, err = WebSocketHandler(ctx, request("hello", "abc", `{"action": "hello"}`))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("hello = %d, %v", resp.StatusCode, err)
+	}
+	var msg struct {
+		Type  string                  `json:"type"`
+		Rates []ratestore.DashUSDRate `json:"rates"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "rates" || len(msg.Rates) != 1 || msg.Rates[0].RateUSD != 100 {
+		t.Errorf("hello reply = %s", resp.Body)
+	}
+
+	// anything else is answered with an error pointing at hello
+	resp, err = WebSocketHandler(ctx, request("$default", "abc", `{"action": "rates"}`))
+	if err != nil || resp.StatusCode != 400 || !strings.Contains(resp.Body, "hello") {
+		t.Errorf("unknown action = %d %s, %v", resp.StatusCode, resp.Body, err)
+	}
+
+	resp, err = WebSocketHandler(ctx, request("$disconnect", "abc", ""))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("$disconnect = %d, %v", resp.StatusCode, err)
+	}
+	if ok, _ := mr.SIsMember(push.ConnectionsKey(), "abc"); ok {
+		t.Error("client not forgotten on $disconnect")
+	}
+}